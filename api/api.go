@@ -0,0 +1,443 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/medusalix/multispeaker/audio"
+	"github.com/medusalix/multispeaker/log"
+	"github.com/medusalix/multispeaker/network"
+)
+
+// Server is used to control the music server over HTTP
+type Server struct {
+	addr     string
+	server   *network.Server
+	mux      *http.ServeMux
+	handlers map[string]map[string]handler
+}
+
+type handler func(request *http.Request) (interface{}, error)
+
+// requestError is returned for invalid requests
+type requestError struct {
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// notFoundError is returned for requests with a missing file
+type notFoundError struct {
+	message string
+}
+
+func (e *notFoundError) Error() string {
+	return e.message
+}
+
+type statusResponse struct {
+	Playing  bool    `json:"playing"`
+	Paused   bool    `json:"paused"`
+	Track    string  `json:"track,omitempty"`
+	Title    string  `json:"title,omitempty"`
+	Artist   string  `json:"artist,omitempty"`
+	Album    string  `json:"album,omitempty"`
+	Position float64 `json:"position"`
+	Length   float64 `json:"length"`
+	Repeat   string  `json:"repeat"`
+}
+
+type playRequest struct {
+	// File or directory, plays the queue if empty
+	Path string `json:"path"`
+}
+
+type seekRequest struct {
+	// Position in seconds
+	Position float64 `json:"position"`
+	// Whether the position is relative to the current one
+	Relative bool `json:"relative"`
+}
+
+type queueRequest struct {
+	Path string `json:"path"`
+}
+
+type queueResponse struct {
+	Tracks  []string `json:"tracks"`
+	Current int      `json:"current"`
+}
+
+type repeatRequest struct {
+	Mode string `json:"mode"`
+}
+
+type volumeRequest struct {
+	// User name or 'all'
+	User   string `json:"user"`
+	Volume int    `json:"volume"`
+}
+
+type muteRequest struct {
+	// User name or 'all'
+	User  string `json:"user"`
+	Muted bool   `json:"muted"`
+}
+
+type channelMapRequest struct {
+	// User name or 'all'
+	User string `json:"user"`
+	Map  string `json:"map"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewServer constructs a new HTTP server for the given music server
+func NewServer(addr string, server *network.Server) *Server {
+	s := &Server{
+		addr:     addr,
+		server:   server,
+		mux:      http.NewServeMux(),
+		handlers: make(map[string]map[string]handler),
+	}
+
+	s.handle("/status", http.MethodGet, s.getStatus)
+	s.handle("/users", http.MethodGet, s.listUsers)
+	s.handle("/play", http.MethodPost, s.playMusic)
+	s.handle("/stop", http.MethodPost, s.stopMusic)
+	s.handle("/pause", http.MethodPost, s.pauseMusic)
+	s.handle("/resume", http.MethodPost, s.resumeMusic)
+	s.handle("/seek", http.MethodPost, s.seekMusic)
+	s.handle("/queue", http.MethodGet, s.listQueue)
+	s.handle("/queue", http.MethodPost, s.addToQueue)
+	s.handle("/next", http.MethodPost, s.nextTrack)
+	s.handle("/prev", http.MethodPost, s.previousTrack)
+	s.handle("/shuffle", http.MethodPost, s.shuffleQueue)
+	s.handle("/repeat", http.MethodPost, s.setRepeat)
+	s.handle("/volume", http.MethodPost, s.changeVolume)
+	s.handle("/mute", http.MethodPost, s.setMuted)
+	s.handle("/map", http.MethodPost, s.mapChannels)
+
+	return s
+}
+
+// Start starts listening for HTTP requests
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("HTTP API listening on '%s'", listener.Addr())
+
+	go func() {
+		if err := http.Serve(listener, s.mux); err != nil {
+			log.Error("HTTP API stopped: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// handle registers a handler for a path and method
+func (s *Server) handle(path string, method string, handle handler) {
+	methods, ok := s.handlers[path]
+
+	if !ok {
+		methods = make(map[string]handler)
+		s.handlers[path] = methods
+
+		s.mux.HandleFunc(path, func(writer http.ResponseWriter, request *http.Request) {
+			s.serve(writer, request, methods)
+		})
+	}
+
+	methods[method] = handle
+}
+
+func (s *Server) serve(writer http.ResponseWriter, request *http.Request, methods map[string]handler) {
+	handle, ok := methods[request.Method]
+
+	if !ok {
+		writeJSON(writer, http.StatusMethodNotAllowed, &errorResponse{
+			Error: "method not allowed",
+		})
+
+		return
+	}
+
+	response, err := handle(request)
+
+	if err != nil {
+		// Other errors are caused by the state of the playback
+		status := http.StatusConflict
+
+		switch err.(type) {
+		case *requestError:
+			status = http.StatusBadRequest
+		case *notFoundError:
+			status = http.StatusNotFound
+		}
+
+		writeJSON(writer, status, &errorResponse{
+			Error: err.Error(),
+		})
+
+		return
+	}
+
+	if response == nil {
+		writer.WriteHeader(http.StatusNoContent)
+
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, response)
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		log.Debug("Error writing HTTP response: ", err)
+	}
+}
+
+// pathError explains why the music of a path can't be played,
+// other errors are caused by the state of the playback
+func pathError(err error) error {
+	var pathErr *network.PathError
+
+	if !errors.As(err, &pathErr) {
+		return err
+	}
+
+	if errors.Is(err, os.ErrNotExist) {
+		return &notFoundError{err.Error()}
+	}
+
+	return &requestError{err.Error()}
+}
+
+func readJSON(request *http.Request, value interface{}) error {
+	if err := json.NewDecoder(request.Body).Decode(value); err != nil {
+		return &requestError{"invalid request body: " + err.Error()}
+	}
+
+	return nil
+}
+
+func (s *Server) getStatus(request *http.Request) (interface{}, error) {
+	status := s.server.Status()
+
+	return &statusResponse{
+		Playing:  status.Playing,
+		Paused:   status.Paused,
+		Track:    status.Track,
+		Title:    status.Metadata.Title,
+		Artist:   status.Metadata.Artist,
+		Album:    status.Metadata.Album,
+		Position: status.Position.Seconds(),
+		Length:   status.Length.Seconds(),
+		Repeat:   status.Repeat.String(),
+	}, nil
+}
+
+func (s *Server) listUsers(request *http.Request) (interface{}, error) {
+	return s.server.GetConnectedUsers(), nil
+}
+
+func (s *Server) playMusic(request *http.Request) (interface{}, error) {
+	var body playRequest
+
+	// Body is optional
+	if request.ContentLength != 0 {
+		if err := readJSON(request, &body); err != nil {
+			return nil, err
+		}
+	}
+
+	if body.Path == "" {
+		return nil, s.server.PlayQueue()
+	}
+
+	return nil, pathError(s.server.PlayMusic(body.Path))
+}
+
+func (s *Server) stopMusic(request *http.Request) (interface{}, error) {
+	return nil, s.server.StopMusic()
+}
+
+func (s *Server) pauseMusic(request *http.Request) (interface{}, error) {
+	return nil, s.server.Pause()
+}
+
+func (s *Server) resumeMusic(request *http.Request) (interface{}, error) {
+	return nil, s.server.Resume()
+}
+
+func (s *Server) seekMusic(request *http.Request) (interface{}, error) {
+	var body seekRequest
+
+	if err := readJSON(request, &body); err != nil {
+		return nil, err
+	}
+
+	position := time.Duration(body.Position * float64(time.Second))
+
+	if body.Relative {
+		current, err := s.server.Position()
+
+		if err != nil {
+			return nil, err
+		}
+
+		position += current
+	}
+
+	if position < 0 {
+		position = 0
+	}
+
+	return nil, s.server.Seek(position)
+}
+
+func (s *Server) listQueue(request *http.Request) (interface{}, error) {
+	tracks, current := s.server.Queue()
+
+	return &queueResponse{
+		Tracks:  tracks,
+		Current: current,
+	}, nil
+}
+
+func (s *Server) addToQueue(request *http.Request) (interface{}, error) {
+	var body queueRequest
+
+	if err := readJSON(request, &body); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.server.Enqueue(body.Path); err != nil {
+		return nil, pathError(err)
+	}
+
+	return s.listQueue(request)
+}
+
+func (s *Server) nextTrack(request *http.Request) (interface{}, error) {
+	return nil, s.server.Next()
+}
+
+func (s *Server) previousTrack(request *http.Request) (interface{}, error) {
+	return nil, s.server.Previous()
+}
+
+func (s *Server) shuffleQueue(request *http.Request) (interface{}, error) {
+	s.server.Shuffle()
+
+	return s.listQueue(request)
+}
+
+func (s *Server) setRepeat(request *http.Request) (interface{}, error) {
+	var body repeatRequest
+
+	if err := readJSON(request, &body); err != nil {
+		return nil, err
+	}
+
+	mode, err := network.ParseRepeatMode(body.Mode)
+
+	if err != nil {
+		return nil, &requestError{err.Error()}
+	}
+
+	s.server.SetRepeat(mode)
+
+	return nil, nil
+}
+
+func (s *Server) changeVolume(request *http.Request) (interface{}, error) {
+	body := volumeRequest{
+		User: "all",
+	}
+
+	if err := readJSON(request, &body); err != nil {
+		return nil, err
+	}
+
+	if body.Volume < 0 || body.Volume > 100 {
+		return nil, &requestError{"volume must be in range 0 to 100"}
+	}
+
+	if err := s.server.SetVolume(body.User, body.Volume); err != nil {
+		return nil, &requestError{err.Error()}
+	}
+
+	return nil, nil
+}
+
+func (s *Server) setMuted(request *http.Request) (interface{}, error) {
+	body := muteRequest{
+		User:  "all",
+		Muted: true,
+	}
+
+	if err := readJSON(request, &body); err != nil {
+		return nil, err
+	}
+
+	if err := s.server.SetMuted(body.User, body.Muted); err != nil {
+		return nil, &requestError{err.Error()}
+	}
+
+	return nil, nil
+}
+
+func (s *Server) mapChannels(request *http.Request) (interface{}, error) {
+	body := channelMapRequest{
+		User: "all",
+	}
+
+	if err := readJSON(request, &body); err != nil {
+		return nil, err
+	}
+
+	mapping, err := audio.ParseChannelMap(body.Map)
+
+	if err != nil {
+		return nil, &requestError{err.Error()}
+	}
+
+	if err := s.server.SetChannelMap(body.User, mapping); err != nil {
+		return nil, &requestError{err.Error()}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Speaker positions of the channels
+const (
+	frontLeft = iota
+	frontRight
+	frontCenter
+	lowFrequency
+	backLeft
+	backRight
+	backCenter
+	sideLeft
+	sideRight
+)
+
+// Order of the channels for each channel count (same as WAV and FLAC)
+var channelLayouts = [MaxChannels + 1][]int{
+	1: {frontCenter},
+	2: {frontLeft, frontRight},
+	3: {frontLeft, frontRight, frontCenter},
+	4: {frontLeft, frontRight, backLeft, backRight},
+	5: {frontLeft, frontRight, frontCenter, backLeft, backRight},
+	6: {frontLeft, frontRight, frontCenter, lowFrequency, backLeft, backRight},
+	7: {frontLeft, frontRight, frontCenter, lowFrequency, backCenter, sideLeft, sideRight},
+	8: {frontLeft, frontRight, frontCenter, lowFrequency, backLeft, backRight, sideLeft, sideRight},
+}
+
+// Gain of a channel that is split between two speakers (-3 dB)
+var splitGain = math.Sqrt(0.5)
+
+// channelFallback is a speaker that plays a missing channel
+type channelFallback struct {
+	position int
+	gain     float64
+}
+
+// Speakers used for positions missing in the layout, the low frequency channel is dropped
+var channelFallbacks = map[int][]channelFallback{
+	frontLeft:   {{frontCenter, 1}},
+	frontRight:  {{frontCenter, 1}},
+	frontCenter: {{frontLeft, splitGain}, {frontRight, splitGain}},
+	backLeft:    {{frontLeft, splitGain}},
+	backRight:   {{frontRight, splitGain}},
+	backCenter:  {{backLeft, splitGain}, {backRight, splitGain}},
+	sideLeft:    {{backLeft, 1}},
+	sideRight:   {{backRight, 1}},
+}
+
+// ChannelMap specifies which channels a client plays on its speakers
+type ChannelMap int
+
+const (
+	// MapStereo plays all channels, mixed to stereo
+	MapStereo ChannelMap = iota
+	// MapLeft plays the left channel on both speakers
+	MapLeft
+	// MapRight plays the right channel on both speakers
+	MapRight
+	// MapMono plays all channels, mixed to mono
+	MapMono
+)
+
+var channelMapNames = []string{"stereo", "left", "right", "mono"}
+
+// Applied to stereo samples, rows are the output channels
+var channelMapMatrices = [][][]float64{
+	MapStereo: {{1, 0}, {0, 1}},
+	MapLeft:   {{1, 0}, {1, 0}},
+	MapRight:  {{0, 1}, {0, 1}},
+	MapMono:   {{0.5, 0.5}, {0.5, 0.5}},
+}
+
+// ParseChannelMap returns the channel map with the given name
+func ParseChannelMap(name string) (ChannelMap, error) {
+	for i, mapName := range channelMapNames {
+		if strings.EqualFold(name, mapName) {
+			return ChannelMap(i), nil
+		}
+	}
+
+	return MapStereo, fmt.Errorf("unknown channel map '%s'", name)
+}
+
+func (m ChannelMap) String() string {
+	return channelMapNames[m]
+}
+
+// CheckChannelMap checks if the channel map is known
+func CheckChannelMap(mapping ChannelMap) error {
+	if mapping < 0 || int(mapping) >= len(channelMapNames) {
+		return fmt.Errorf("unknown channel map %d", int(mapping))
+	}
+
+	return nil
+}
+
+// CheckChannels checks if samples with the channel count can be mixed
+func CheckChannels(channels int) error {
+	if channels < 1 || channels > MaxChannels {
+		return fmt.Errorf("%d channels are not supported", channels)
+	}
+
+	return nil
+}
+
+// channelMixer converts 16 bit samples to another channel count
+type channelMixer struct {
+	// Gain of each input channel for each output channel
+	matrix [][]float64
+}
+
+// newChannelMixer up- or downmixes the channels based on their speaker positions
+func newChannelMixer(from int, to int) *channelMixer {
+	matrix := make([][]float64, to)
+
+	for i := range matrix {
+		matrix[i] = make([]float64, from)
+	}
+
+	for i, position := range channelLayouts[from] {
+		// Mono is played at full volume on both speakers
+		if from == 1 && to > 1 && !hasPosition(channelLayouts[to], frontCenter) {
+			matrix[0][i] = 1
+			matrix[1][i] = 1
+
+			continue
+		}
+
+		addChannel(matrix, channelLayouts[to], i, position, 1)
+	}
+
+	// Mixed channels must not clip, so the gains of each output channel are scaled
+	// to a sum of 1 (deliberately instead of the plain ITU-R BS.775 coefficients).
+	// For 5.1 the front channels are played at about 0.41 (-7.7 dB) in stereo,
+	// the center and back channels at about 0.29.
+	for _, gains := range matrix {
+		sum := 0.0
+
+		for _, gain := range gains {
+			sum += gain
+		}
+
+		if sum <= 1 {
+			continue
+		}
+
+		for i := range gains {
+			gains[i] /= sum
+		}
+	}
+
+	return &channelMixer{matrix}
+}
+
+// newMappedMixer mixes the channels to stereo and applies the channel map
+func newMappedMixer(from int, mapping ChannelMap) *channelMixer {
+	stereo := newChannelMixer(from, 2)
+	mapMatrix := channelMapMatrices[mapping]
+	matrix := make([][]float64, 2)
+
+	for i := range matrix {
+		matrix[i] = make([]float64, from)
+
+		for j := range matrix[i] {
+			for k, gain := range mapMatrix[i] {
+				matrix[i][j] += gain * stereo.matrix[k][j]
+			}
+		}
+	}
+
+	return &channelMixer{matrix}
+}
+
+// addChannel adds the input channel to the output channel at its position or to the fallbacks
+func addChannel(matrix [][]float64, layout []int, channel int, position int, gain float64) {
+	for i, p := range layout {
+		if p == position {
+			matrix[i][channel] += gain
+
+			return
+		}
+	}
+
+	for _, fallback := range channelFallbacks[position] {
+		addChannel(matrix, layout, channel, fallback.position, gain*fallback.gain)
+	}
+}
+
+func hasPosition(layout []int, position int) bool {
+	for _, p := range layout {
+		if p == position {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scale multiplies the gains of all channels with the factor
+func (m *channelMixer) scale(factor float64) {
+	for _, gains := range m.matrix {
+		for i := range gains {
+			gains[i] *= factor
+		}
+	}
+}
+
+// isIdentity checks if the samples are passed through unchanged
+func (m *channelMixer) isIdentity() bool {
+	if len(m.matrix) != len(m.matrix[0]) {
+		return false
+	}
+
+	for i, gains := range m.matrix {
+		for j, gain := range gains {
+			if i == j && gain != 1 || i != j && gain != 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// mix converts the samples, incomplete frames are ignored
+func (m *channelMixer) mix(samples []byte) []byte {
+	from := len(m.matrix[0])
+	frames := len(samples) / (from * 2)
+	mixed := make([]byte, frames*len(m.matrix)*2)
+	values := make([]float64, from)
+	offset := 0
+
+	for i := 0; i < frames; i++ {
+		for c := range values {
+			index := (i*from + c) * 2
+			values[c] = float64(int16(samples[index]) | int16(samples[index+1])<<8)
+		}
+
+		for _, gains := range m.matrix {
+			value := 0.0
+
+			for c, gain := range gains {
+				value += values[c] * gain
+			}
+
+			sample := roundSample(value)
+			mixed[offset] = byte(sample)
+			mixed[offset+1] = byte(sample >> 8)
+			offset += 2
+		}
+	}
+
+	return mixed
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// Gains of 5.1 downmixed to stereo, the rows are scaled to a sum of 1
+var (
+	surroundFront = 1 / (1 + 2*splitGain)
+	surroundSide  = splitGain / (1 + 2*splitGain)
+)
+
+func checkMatrix(t *testing.T, expected [][]float64, matrix [][]float64) {
+	t.Helper()
+
+	if len(matrix) != len(expected) {
+		t.Fatalf("Expected %d output channels, got %d", len(expected), len(matrix))
+	}
+
+	for i, gains := range expected {
+		if len(matrix[i]) != len(gains) {
+			t.Fatalf("Expected %d input channels, got %d", len(gains), len(matrix[i]))
+		}
+
+		for j, gain := range gains {
+			if math.Abs(matrix[i][j]-gain) > 1e-9 {
+				t.Errorf("Gain of channel %d for output %d: expected %.4f, got %.4f", j, i, gain, matrix[i][j])
+			}
+		}
+	}
+}
+
+func TestChannelMixerMatrix(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   int
+		to     int
+		matrix [][]float64
+	}{
+		{"mono to stereo", 1, 2, [][]float64{{1}, {1}}},
+		{"stereo to mono", 2, 1, [][]float64{{0.5, 0.5}}},
+		{"stereo", 2, 2, [][]float64{{1, 0}, {0, 1}}},
+		{"mono to 5.1", 1, 6, [][]float64{{0}, {0}, {1}, {0}, {0}, {0}}},
+		{
+			"3.0 to stereo", 3, 2, [][]float64{
+				{1 / (1 + splitGain), 0, splitGain / (1 + splitGain)},
+				{0, 1 / (1 + splitGain), splitGain / (1 + splitGain)},
+			},
+		},
+		{
+			// Low frequency channel is dropped
+			"5.1 to stereo", 6, 2, [][]float64{
+				{surroundFront, 0, surroundSide, 0, surroundSide, 0},
+				{0, surroundFront, surroundSide, 0, 0, surroundSide},
+			},
+		},
+		{
+			// Side channels are played on the back speakers
+			"7.1 to 5.1", 8, 6, [][]float64{
+				{1, 0, 0, 0, 0, 0, 0, 0},
+				{0, 1, 0, 0, 0, 0, 0, 0},
+				{0, 0, 1, 0, 0, 0, 0, 0},
+				{0, 0, 0, 1, 0, 0, 0, 0},
+				{0, 0, 0, 0, 0.5, 0, 0.5, 0},
+				{0, 0, 0, 0, 0, 0.5, 0, 0.5},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkMatrix(t, test.matrix, newChannelMixer(test.from, test.to).matrix)
+		})
+	}
+}
+
+func TestMappedMixerMatrix(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    int
+		mapping ChannelMap
+		matrix  [][]float64
+	}{
+		{"stereo", 2, MapStereo, [][]float64{{1, 0}, {0, 1}}},
+		{"left", 2, MapLeft, [][]float64{{1, 0}, {1, 0}}},
+		{"right", 2, MapRight, [][]float64{{0, 1}, {0, 1}}},
+		{"mono", 2, MapMono, [][]float64{{0.5, 0.5}, {0.5, 0.5}}},
+		{"mono source on the left", 1, MapLeft, [][]float64{{1}, {1}}},
+		{
+			"5.1 on the right", 6, MapRight, [][]float64{
+				{0, surroundFront, surroundSide, 0, 0, surroundSide},
+				{0, surroundFront, surroundSide, 0, 0, surroundSide},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkMatrix(t, test.matrix, newMappedMixer(test.from, test.mapping).matrix)
+		})
+	}
+
+	if !newMappedMixer(2, MapStereo).isIdentity() {
+		t.Error("Stereo samples aren't passed through")
+	}
+
+	if newMappedMixer(2, MapMono).isIdentity() {
+		t.Error("Mono map is passed through")
+	}
+}
+
+// Full-scale channels don't clip when mixed, incomplete frames are ignored
+func TestChannelMixerMix(t *testing.T) {
+	samples := testSamples(2, 6, func(i int, c int) int16 {
+		if i == 0 {
+			return math.MaxInt16
+		}
+
+		return math.MinInt16
+	})
+	expected := testSamples(2, 2, func(i int, c int) int16 {
+		if i == 0 {
+			return math.MaxInt16
+		}
+
+		return math.MinInt16
+	})
+
+	mixed := newChannelMixer(6, 2).mix(append(samples, 0, 0, 0))
+
+	if !bytes.Equal(mixed, expected) {
+		t.Errorf("Expected %v, got %v", expected, mixed)
+	}
+}
+
+func TestParseChannelMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping ChannelMap
+		valid   bool
+	}{
+		{"stereo", MapStereo, true},
+		{"LEFT", MapLeft, true},
+		{"Right", MapRight, true},
+		{"mono", MapMono, true},
+		{"", MapStereo, false},
+		{"center", MapStereo, false},
+		{"left ", MapStereo, false},
+	}
+
+	for _, test := range tests {
+		mapping, err := ParseChannelMap(test.name)
+
+		if test.valid != (err == nil) || mapping != test.mapping {
+			t.Errorf("'%s': expected %s (valid %t), got %s (%v)", test.name, test.mapping, test.valid, mapping, err)
+		}
+	}
+
+	for _, mapping := range []ChannelMap{MapStereo, MapLeft, MapRight, MapMono} {
+		if parsed, err := ParseChannelMap(mapping.String()); err != nil || parsed != mapping {
+			t.Errorf("Name of %s isn't parsed back: %v", mapping, err)
+		}
+	}
+
+	for _, mapping := range []ChannelMap{-1, MapMono + 1} {
+		if CheckChannelMap(mapping) == nil {
+			t.Errorf("Unknown channel map %d was accepted", int(mapping))
+		}
+	}
+}
+
+func TestCheckChannels(t *testing.T) {
+	for channels := -1; channels <= MaxChannels+1; channels++ {
+		valid := channels >= 1 && channels <= MaxChannels
+
+		if err := CheckChannels(channels); valid != (err == nil) {
+			t.Errorf("%d channels: expected valid %t, got %v", channels, valid, err)
+		}
+	}
+}
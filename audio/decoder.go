@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mp3 "github.com/hajimehoshi/go-mp3"
+)
+
+// Length of the header used to detect the file format
+const signatureSize = 12
+
+// Decoder is used to decode samples from an audio file
+type Decoder interface {
+	// Format returns the format of the decoded samples
+	Format() Format
+	// Tags returns the metadata of the file
+	Tags() Tags
+	// Read reads samples (16 bit, channels of the format) into the buffer
+	Read(buffer []byte) (int, error)
+	// Length returns the number of frames (0 if unknown)
+	Length() int64
+	// SeekFrame sets the position to the given frame
+	SeekFrame(frame int64) error
+	// Close closes the decoder and its file
+	Close() error
+}
+
+type decoderFormat struct {
+	name       string
+	extensions []string
+	matches    func(signature []byte) bool
+	newDecoder func(file *os.File) (Decoder, error)
+}
+
+var decoderFormats = []decoderFormat{
+	{"WAV", []string{".wav"}, matchWav, newWavDecoder},
+	{"FLAC", []string{".flac"}, matchFlac, newFlacDecoder},
+	{"Ogg Vorbis", []string{".ogg", ".oga"}, matchVorbis, newVorbisDecoder},
+	{"MP3", []string{".mp3"}, matchMp3, newMp3Decoder},
+}
+
+// NewDecoder detects the format of a file by its signature
+// and constructs a matching decoder
+func NewDecoder(file *os.File) (Decoder, error) {
+	signature := make([]byte, signatureSize)
+	n, err := io.ReadFull(file, signature)
+
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	// Rewind file for the actual decoder
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	for _, format := range decoderFormats {
+		if !format.matches(signature[:n]) {
+			continue
+		}
+
+		decoder, err := format.newDecoder(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := CheckChannels(decoder.Format().Channels); err != nil {
+			return nil, err
+		}
+
+		return decoder, nil
+	}
+
+	return nil, errors.New("unsupported file format")
+}
+
+// HasAudioExtension checks if a file has the extension of a supported format
+func HasAudioExtension(filePath string) bool {
+	extension := strings.ToLower(filepath.Ext(filePath))
+
+	for _, format := range decoderFormats {
+		for _, formatExtension := range format.extensions {
+			if extension == formatExtension {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func matchMp3(signature []byte) bool {
+	// ID3v2 tag or MPEG frame sync
+	if bytes.HasPrefix(signature, []byte("ID3")) {
+		return true
+	}
+
+	return len(signature) >= 2 && signature[0] == 0xff && signature[1]&0xe0 == 0xe0
+}
+
+type mp3Decoder struct {
+	*mp3.Decoder
+	tags Tags
+}
+
+func newMp3Decoder(file *os.File) (Decoder, error) {
+	// Tags are read before the decoder moves the file position
+	tags := readID3v2(file)
+
+	// Older files only have an ID3v1 tag, ID3v2 takes precedence
+	if info, err := file.Stat(); err == nil {
+		for name, value := range readID3v1(file, info.Size()) {
+			tags.add(name, value)
+		}
+	}
+
+	decoder, err := mp3.NewDecoder(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &mp3Decoder{decoder, tags}, nil
+}
+
+func (d *mp3Decoder) Format() Format {
+	// Decoder always returns stereo samples
+	return Format{
+		SampleRate: d.SampleRate(),
+		Channels:   2,
+		BitDepth:   BitDepth,
+	}
+}
+
+func (d *mp3Decoder) Tags() Tags {
+	return d.tags
+}
+
+func (d *mp3Decoder) Length() int64 {
+	// Length is given in bytes
+	return d.Decoder.Length() / 4
+}
+
+func (d *mp3Decoder) SeekFrame(frame int64) error {
+	_, err := d.Decoder.Seek(frame*4, io.SeekStart)
+
+	return err
+}
+
+// pcmBuffer holds converted samples until they are read
+type pcmBuffer struct {
+	format  Format
+	tags    Tags
+	samples []byte
+	fill    func() error
+	// Frames to discard after seeking
+	skip int64
+}
+
+func (b *pcmBuffer) Format() Format {
+	return b.format
+}
+
+func (b *pcmBuffer) Tags() Tags {
+	return b.tags
+}
+
+func (b *pcmBuffer) read(buffer []byte) (int, error) {
+	for len(b.samples) == 0 {
+		if err := b.fill(); err != nil {
+			return 0, err
+		}
+
+		b.skipFrames()
+	}
+
+	n := copy(buffer, b.samples)
+	b.samples = b.samples[n:]
+
+	return n, nil
+}
+
+// reset discards the buffered samples and a number of upcoming frames
+func (b *pcmBuffer) reset(skip int64) {
+	b.samples = nil
+	b.skip = skip
+}
+
+func (b *pcmBuffer) skipFrames() {
+	frameSize := b.format.FrameSize()
+	skipped := int64(len(b.samples) / frameSize)
+
+	if skipped > b.skip {
+		skipped = b.skip
+	}
+
+	b.samples = b.samples[skipped*int64(frameSize):]
+	b.skip -= skipped
+}
+
+// appendSample appends a 16 bit sample, the channels of a frame are appended in order
+func (b *pcmBuffer) appendSample(sample int16) {
+	b.samples = append(b.samples, byte(sample), byte(sample>>8))
+}
+
+// floatToSample converts a float sample in range -1 <= x <= 1
+func floatToSample(value float64) int16 {
+	if value >= 1 {
+		return 32767
+	}
+
+	if value <= -1 {
+		return -32768
+	}
+
+	return int16(value * 32767)
+}
+
+// scaleSample converts a sample with the given bit depth
+func scaleSample(value int32, bitDepth int) int16 {
+	if bitDepth > 16 {
+		return int16(value >> uint(bitDepth-16))
+	}
+
+	return int16(value << uint(16-bitDepth))
+}
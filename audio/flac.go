@@ -0,0 +1,258 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+const (
+	// Number of bytes searched for a frame header at once
+	flacSearchSize = 64 * 1024
+	// Maximum size of a frame header
+	flacHeaderSize = 16
+)
+
+type flacDecoder struct {
+	pcmBuffer
+	file        *os.File
+	reader      *bufio.Reader
+	info        *meta.StreamInfo
+	audioOffset int64
+	fileSize    int64
+}
+
+func matchFlac(signature []byte) bool {
+	return bytes.HasPrefix(signature, []byte("fLaC"))
+}
+
+func newFlacDecoder(file *os.File) (Decoder, error) {
+	// Metadata blocks contain the Vorbis comments
+	stream, err := flac.Parse(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	audioOffset, err := flacAudioOffset(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := &flacDecoder{
+		file:        file,
+		reader:      bufio.NewReader(file),
+		info:        stream.Info,
+		audioOffset: audioOffset,
+		fileSize:    info.Size(),
+	}
+	d.fill = d.decodeFrame
+	d.format = Format{
+		SampleRate: int(stream.Info.SampleRate),
+		Channels:   int(stream.Info.NChannels),
+		BitDepth:   BitDepth,
+	}
+	d.tags = flacTags(stream.Blocks)
+
+	if err := d.SeekFrame(0); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// flacTags reads the Vorbis comments of the metadata blocks
+func flacTags(blocks []*meta.Block) Tags {
+	tags := make(Tags)
+
+	for _, block := range blocks {
+		comment, ok := block.Body.(*meta.VorbisComment)
+
+		if !ok {
+			continue
+		}
+
+		for _, tag := range comment.Tags {
+			tags.add(tag[0], tag[1])
+		}
+	}
+
+	return tags
+}
+
+// flacAudioOffset returns the offset of the first frame after the metadata
+func flacAudioOffset(file *os.File) (int64, error) {
+	header := make([]byte, 4)
+
+	// Skip 'fLaC'
+	offset := int64(4)
+
+	for {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			return 0, err
+		}
+
+		size := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		offset += 4 + size
+
+		// Last metadata block
+		if header[0]&0x80 != 0 {
+			return offset, nil
+		}
+	}
+}
+
+func (d *flacDecoder) Read(buffer []byte) (int, error) {
+	return d.read(buffer)
+}
+
+func (d *flacDecoder) Length() int64 {
+	return int64(d.info.NSamples)
+}
+
+func (d *flacDecoder) SeekFrame(position int64) error {
+	offset := d.audioOffset
+	length := d.Length()
+
+	// Estimate the offset of the frame
+	if length > 0 {
+		offset += int64(float64(d.fileSize-d.audioOffset) * float64(position) / float64(length))
+	}
+
+	for {
+		start, err := d.findFrame(offset)
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		// Decode from the found frame up to the position
+		if err == nil && start <= position {
+			d.reset(position - start)
+
+			return nil
+		}
+
+		if offset == d.audioOffset {
+			return io.ErrUnexpectedEOF
+		}
+
+		// Frame lies behind the position, search further back
+		offset -= flacSearchSize
+
+		if offset < d.audioOffset {
+			offset = d.audioOffset
+		}
+	}
+}
+
+func (d *flacDecoder) Close() error {
+	return d.file.Close()
+}
+
+// findFrame moves the reader to the next frame after the offset
+// and returns the position of the frame's first sample
+func (d *flacDecoder) findFrame(offset int64) (int64, error) {
+	buffer := make([]byte, flacSearchSize)
+
+	for {
+		n, err := d.file.ReadAt(buffer, offset)
+
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		for i := 0; i < n-1; i++ {
+			// Check for frame sync code
+			if buffer[i] != 0xff || buffer[i+1]&0xfe != 0xf8 {
+				continue
+			}
+
+			header, headerErr := frame.New(bytes.NewReader(buffer[i:n]))
+
+			if headerErr != nil || !d.matchesStream(header) {
+				continue
+			}
+
+			if _, err := d.file.Seek(offset+int64(i), io.SeekStart); err != nil {
+				return 0, err
+			}
+
+			d.reader.Reset(d.file)
+
+			if header.HasFixedBlockSize {
+				return int64(header.Num) * int64(d.info.BlockSizeMin), nil
+			}
+
+			return int64(header.Num), nil
+		}
+
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+
+		// Header might cross the end of the buffer
+		offset += int64(n - flacHeaderSize)
+	}
+}
+
+func (d *flacDecoder) matchesStream(header *frame.Frame) bool {
+	// Zero values refer to the stream info
+	sampleRate := header.SampleRate == 0 || header.SampleRate == d.info.SampleRate
+	bitDepth := header.BitsPerSample == 0 || header.BitsPerSample == d.info.BitsPerSample
+
+	return sampleRate && bitDepth
+}
+
+func (d *flacDecoder) decodeFrame() error {
+	audioFrame, err := frame.Parse(d.reader)
+
+	if err != nil {
+		return err
+	}
+
+	bitDepth := int(d.info.BitsPerSample)
+	subframes := audioFrame.Subframes
+
+	// Frames must match the channel count of the stream
+	if len(subframes) != d.format.Channels {
+		return errors.New("flac: channel count of frame doesn't match the stream")
+	}
+
+	for i := range subframes[0].Samples {
+		for _, subframe := range subframes {
+			d.appendSample(scaleSample(subframe.Samples[i], bitDepth))
+		}
+	}
+
+	return nil
+}
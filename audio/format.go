@@ -0,0 +1,47 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import "time"
+
+// Samples are decoded with 16 bits
+const BitDepth = 16
+
+// MaxChannels is the highest channel count of the supported layouts
+const MaxChannels = 8
+
+// Format describes interleaved, signed little-endian samples
+type Format struct {
+	SampleRate int
+	Channels   int
+	BitDepth   int
+}
+
+// FrameSize returns the size of one sample for each channel
+func (f Format) FrameSize() int {
+	return f.Channels * f.BitDepth / 8
+}
+
+// Frames returns the number of frames played in the given time
+func (f Format) Frames(duration time.Duration) int64 {
+	return int64(duration) * int64(f.SampleRate) / int64(time.Second)
+}
+
+// Duration returns the time it takes to play the given number of frames
+func (f Format) Duration(frames int64) time.Duration {
+	return time.Duration(frames) * time.Second / time.Duration(f.SampleRate)
+}
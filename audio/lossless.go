@@ -0,0 +1,395 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Blocks are either stored verbatim or compressed
+const (
+	losslessVerbatim = iota
+	losslessCompressed
+)
+
+const (
+	// Highest order of the fixed predictors
+	maxPredictorOrder = 3
+	// Highest Rice parameter (5 bits)
+	maxRiceParameter = 31
+	// Unary quotient that marks a residual stored in 32 bits
+	riceEscape = 31
+)
+
+var errInvalidBlock = errors.New("invalid lossless block")
+
+// EncodeLossless compresses samples (16 bit) with the given channel count
+// using mid/side stereo, fixed prediction and Rice coding
+func EncodeLossless(samples []byte, channels int) []byte {
+	frameSize := channels * 2
+	frames := len(samples) / frameSize
+	decoded := make([][]int32, channels)
+
+	for c := range decoded {
+		decoded[c] = make([]int32, frames)
+
+		for i := 0; i < frames; i++ {
+			decoded[c][i] = int32(int16(binary.LittleEndian.Uint16(samples[i*frameSize+c*2:])))
+		}
+	}
+
+	// Stereo channels are mostly similar
+	if channels == 2 {
+		for i := 0; i < frames; i++ {
+			left, right := decoded[0][i], decoded[1][i]
+
+			decoded[0][i] = (left + right) >> 1
+			decoded[1][i] = left - right
+		}
+	}
+
+	writer := &bitWriter{
+		buffer: make([]byte, 3, 3+len(samples)),
+	}
+	writer.buffer[0] = losslessCompressed
+	binary.BigEndian.PutUint16(writer.buffer[1:], uint16(frames))
+
+	for _, channel := range decoded {
+		encodeChannel(writer, channel)
+	}
+
+	block := writer.flush()
+
+	// Incompressible samples (e.g. noise) are stored as they are
+	if len(block) >= 1+len(samples) {
+		block = make([]byte, 1+len(samples))
+		block[0] = losslessVerbatim
+		copy(block[1:], samples)
+	}
+
+	return block
+}
+
+// DecodeLossless restores the samples of a compressed block with the given channel count
+func DecodeLossless(block []byte, channels int) ([]byte, error) {
+	if len(block) == 0 {
+		return nil, errInvalidBlock
+	}
+
+	switch block[0] {
+	case losslessVerbatim:
+		samples := make([]byte, len(block)-1)
+		copy(samples, block[1:])
+
+		return samples, nil
+	case losslessCompressed:
+	default:
+		return nil, errInvalidBlock
+	}
+
+	if len(block) < 3 {
+		return nil, errInvalidBlock
+	}
+
+	frames := int(binary.BigEndian.Uint16(block[1:]))
+	reader := &bitReader{
+		buffer: block[3:],
+	}
+	decoded := make([][]int32, channels)
+
+	for c := range decoded {
+		var err error
+		decoded[c], err = decodeChannel(reader, frames)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if channels == 2 {
+		mid, side := decoded[0], decoded[1]
+
+		for i := 0; i < frames; i++ {
+			// Restore the bit lost when halving the sum
+			sum := mid[i]<<1 | side[i]&1
+
+			decoded[0][i] = (sum + side[i]) >> 1
+			decoded[1][i] = (sum - side[i]) >> 1
+		}
+	}
+
+	frameSize := channels * 2
+	samples := make([]byte, frames*frameSize)
+
+	for c, channel := range decoded {
+		for i, sample := range channel {
+			binary.LittleEndian.PutUint16(samples[i*frameSize+c*2:], uint16(int16(sample)))
+		}
+	}
+
+	return samples, nil
+}
+
+func encodeChannel(writer *bitWriter, samples []int32) {
+	order := bestPredictorOrder(samples)
+	residuals := make([]uint32, len(samples))
+
+	for i := range samples {
+		residuals[i] = zigzag(samples[i] - predict(samples, i, order))
+	}
+
+	parameter := bestRiceParameter(residuals)
+
+	writer.write(uint32(order), 2)
+	writer.write(uint32(parameter), 5)
+
+	for _, residual := range residuals {
+		quotient := residual >> uint(parameter)
+
+		if quotient >= riceEscape {
+			writer.writeUnary(riceEscape)
+			writer.write(residual, 32)
+
+			continue
+		}
+
+		writer.writeUnary(quotient)
+		writer.write(residual, parameter)
+	}
+}
+
+func decodeChannel(reader *bitReader, frames int) ([]int32, error) {
+	order, err := reader.read(2)
+
+	if err != nil {
+		return nil, err
+	}
+
+	parameter, err := reader.read(5)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if order > maxPredictorOrder {
+		return nil, errInvalidBlock
+	}
+
+	samples := make([]int32, frames)
+
+	for i := range samples {
+		quotient, err := reader.readUnary(riceEscape)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var residual uint32
+
+		if quotient == riceEscape {
+			residual, err = reader.read(32)
+		} else {
+			residual, err = reader.read(int(parameter))
+			residual |= quotient << parameter
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		samples[i] = unzigzag(residual) + predict(samples, i, int(order))
+	}
+
+	return samples, nil
+}
+
+// predict extrapolates a sample from the previous ones (zero before the block)
+func predict(samples []int32, i int, order int) int32 {
+	previous := func(n int) int32 {
+		if i-n < 0 {
+			return 0
+		}
+
+		return samples[i-n]
+	}
+
+	switch order {
+	case 1:
+		return previous(1)
+	case 2:
+		return 2*previous(1) - previous(2)
+	case 3:
+		return 3*previous(1) - 3*previous(2) + previous(3)
+	}
+
+	return 0
+}
+
+// bestPredictorOrder chooses the predictor with the smallest residuals
+func bestPredictorOrder(samples []int32) int {
+	bestOrder := 0
+	var bestSum int64 = -1
+
+	for order := 0; order <= maxPredictorOrder; order++ {
+		var sum int64
+
+		for i := range samples {
+			residual := int64(samples[i] - predict(samples, i, order))
+
+			if residual < 0 {
+				residual = -residual
+			}
+
+			sum += residual
+		}
+
+		if bestSum < 0 || sum < bestSum {
+			bestOrder = order
+			bestSum = sum
+		}
+	}
+
+	return bestOrder
+}
+
+// bestRiceParameter chooses the parameter resulting in the fewest bits
+func bestRiceParameter(residuals []uint32) int {
+	bestParameter := 0
+	bestBits := -1
+
+	for parameter := 0; parameter <= maxRiceParameter; parameter++ {
+		bits := 0
+
+		for _, residual := range residuals {
+			quotient := int(residual >> uint(parameter))
+
+			if quotient >= riceEscape {
+				bits += riceEscape + 32
+			} else {
+				bits += quotient + 1 + parameter
+			}
+		}
+
+		if bestBits < 0 || bits < bestBits {
+			bestParameter = parameter
+			bestBits = bits
+		}
+	}
+
+	return bestParameter
+}
+
+// zigzag maps signed residuals to unsigned ones (0, -1, 1, -2, ...)
+func zigzag(value int32) uint32 {
+	return uint32(value<<1) ^ uint32(value>>31)
+}
+
+func unzigzag(value uint32) int32 {
+	return int32(value>>1) ^ -int32(value&1)
+}
+
+type bitWriter struct {
+	buffer []byte
+	bits   uint64
+	count  uint
+}
+
+func (w *bitWriter) write(value uint32, bits int) {
+	if bits == 0 {
+		return
+	}
+
+	w.bits = w.bits<<uint(bits) | uint64(value)&(1<<uint(bits)-1)
+	w.count += uint(bits)
+
+	for w.count >= 8 {
+		w.count -= 8
+		w.buffer = append(w.buffer, byte(w.bits>>w.count))
+	}
+}
+
+// writeUnary writes the value as ones terminated by a zero,
+// the escape value is written without the terminating zero
+func (w *bitWriter) writeUnary(value uint32) {
+	for ones := value; ones > 0; {
+		bits := ones
+
+		if bits > 16 {
+			bits = 16
+		}
+
+		w.write(1<<bits-1, int(bits))
+		ones -= bits
+	}
+
+	if value < riceEscape {
+		w.write(0, 1)
+	}
+}
+
+// flush pads the last byte with zeros and returns the written bytes
+func (w *bitWriter) flush() []byte {
+	if w.count > 0 {
+		w.buffer = append(w.buffer, byte(w.bits<<(8-w.count)))
+		w.count = 0
+	}
+
+	return w.buffer
+}
+
+type bitReader struct {
+	buffer []byte
+	offset int
+}
+
+func (r *bitReader) read(bits int) (uint32, error) {
+	if r.offset+bits > len(r.buffer)*8 {
+		return 0, errInvalidBlock
+	}
+
+	var value uint32
+
+	for i := 0; i < bits; i++ {
+		bit := r.buffer[r.offset>>3] >> (7 - uint(r.offset&7)) & 1
+		value = value<<1 | uint32(bit)
+		r.offset++
+	}
+
+	return value, nil
+}
+
+// readUnary counts the ones before a zero, stopping at the limit
+func (r *bitReader) readUnary(limit uint32) (uint32, error) {
+	var value uint32
+
+	for value < limit {
+		bit, err := r.read(1)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if bit == 0 {
+			break
+		}
+
+		value++
+	}
+
+	return value, nil
+}
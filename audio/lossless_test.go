@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// testSamples generates 16 bit samples from the sample value of each frame and channel
+func testSamples(frames int, channels int, sample func(i int, c int) int16) []byte {
+	samples := make([]byte, frames*channels*2)
+
+	for i := 0; i < frames; i++ {
+		for c := 0; c < channels; c++ {
+			binary.LittleEndian.PutUint16(samples[(i*channels+c)*2:], uint16(sample(i, c)))
+		}
+	}
+
+	return samples
+}
+
+func silence(i int, c int) int16 {
+	return 0
+}
+
+// square alternates between the extremes, the channels are inverted
+func square(period int) func(i int, c int) int16 {
+	return func(i int, c int) int16 {
+		if (i/period+c)%2 == 0 {
+			return math.MaxInt16
+		}
+
+		return math.MinInt16
+	}
+}
+
+func sine(i int, c int) int16 {
+	return int16(20000 * math.Sin(float64(i+c*10)*2*math.Pi*440/48000))
+}
+
+func noise(seed int64) func(i int, c int) int16 {
+	random := rand.New(rand.NewSource(seed))
+
+	return func(i int, c int) int16 {
+		return int16(random.Uint32())
+	}
+}
+
+// Decoded samples are bit-exact, compressible ones are smaller than raw PCM
+func TestLosslessRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		channels   int
+		frames     int
+		sample     func(i int, c int) int16
+		compressed bool
+	}{
+		{"empty", 2, 0, silence, false},
+		{"single frame", 2, 1, sine, false},
+		{"silence mono", 1, 1024, silence, true},
+		{"silence stereo", 2, 1024, silence, true},
+		{"silence odd frames", 2, 1023, silence, true},
+		{"square mono", 1, 1000, square(50), true},
+		{"square stereo", 2, 1001, square(50), true},
+		{"square every sample", 2, 1024, square(1), false},
+		{"sine mono", 1, 4801, sine, true},
+		{"sine stereo", 2, 4800, sine, true},
+		{"sine surround", 6, 999, sine, true},
+		{"sine 8 channels", MaxChannels, 1001, sine, true},
+		{"noise mono", 1, 1024, noise(1), false},
+		{"noise stereo", 2, 1025, noise(2), false},
+		{"noise surround", 6, 333, noise(3), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			samples := testSamples(test.frames, test.channels, test.sample)
+			block := EncodeLossless(samples, test.channels)
+			decoded, err := DecodeLossless(block, test.channels)
+
+			if err != nil {
+				t.Fatal("Unable to decode block: ", err)
+			}
+
+			if !bytes.Equal(decoded, samples) {
+				t.Fatal("Decoded samples differ from the encoded ones")
+			}
+
+			if test.compressed && len(block) >= len(samples) {
+				t.Errorf("Block of %d bytes isn't smaller than %d bytes of samples", len(block), len(samples))
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidLossless(t *testing.T) {
+	block := EncodeLossless(testSamples(1024, 2, sine), 2)
+
+	tests := []struct {
+		name  string
+		block []byte
+	}{
+		{"empty", nil},
+		{"unknown type", []byte{0xff, 0, 0}},
+		{"missing frame count", []byte{losslessCompressed, 0}},
+		{"truncated", block[:len(block)/2]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := DecodeLossless(test.block, 2); err == nil {
+				t.Error("Invalid block was decoded")
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Duration of the blocks the loudness is measured in, overlapping by 75%
+	loudnessBlock = time.Millisecond * 400
+	loudnessStep  = loudnessBlock / 4
+	// Blocks below these thresholds (LUFS and LU) are ignored
+	absoluteGate = -70
+	relativeGate = -10
+	// Weight of the surround channels
+	surroundWeight = 1.41
+)
+
+// biquad is a second order IIR filter
+type biquad struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	z1, z2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+
+	return y
+}
+
+// kWeighting returns the shelving and high-pass filters of the K-weighting (ITU-R BS.1770)
+func kWeighting(sampleRate int) [2]biquad {
+	// Shelving filter boosting high frequencies
+	k := math.Tan(math.Pi * 1681.974450955533 / float64(sampleRate))
+	q := 0.7071752369554196
+	vh := math.Pow(10, 3.999843853973347/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+
+	shelving := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	// High-pass filter removing low frequencies
+	k = math.Tan(math.Pi * 38.13547087602444 / float64(sampleRate))
+	q = 0.5003270373238773
+	a0 = 1 + k/q + k*k
+
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	return [2]biquad{shelving, highPass}
+}
+
+// loudnessMeter measures the integrated loudness of 16 bit samples (EBU R128)
+type loudnessMeter struct {
+	channels   int
+	filters    [][2]biquad
+	weights    []float64
+	stepFrames int
+	frames     int
+	energy     float64
+	stepEnergy []float64
+	peak       float64
+}
+
+func newLoudnessMeter(format Format) *loudnessMeter {
+	m := &loudnessMeter{
+		channels:   format.Channels,
+		filters:    make([][2]biquad, format.Channels),
+		weights:    make([]float64, format.Channels),
+		stepFrames: int(format.Frames(loudnessStep)),
+	}
+
+	for i, position := range channelLayouts[format.Channels] {
+		m.filters[i] = kWeighting(format.SampleRate)
+
+		switch position {
+		case lowFrequency:
+			m.weights[i] = 0
+		case backLeft, backRight, backCenter, sideLeft, sideRight:
+			m.weights[i] = surroundWeight
+		default:
+			m.weights[i] = 1
+		}
+	}
+
+	// Mono is played on both speakers
+	if format.Channels == 1 {
+		m.weights[0] = 2
+	}
+
+	return m
+}
+
+// add measures the samples, incomplete frames are ignored
+func (m *loudnessMeter) add(samples []byte) {
+	frames := len(samples) / (m.channels * 2)
+
+	for i := 0; i < frames; i++ {
+		for c := 0; c < m.channels; c++ {
+			index := (i*m.channels + c) * 2
+			value := float64(int16(samples[index])|int16(samples[index+1])<<8) / 32768
+
+			if peak := math.Abs(value); peak > m.peak {
+				m.peak = peak
+			}
+
+			filtered := m.filters[c][1].process(m.filters[c][0].process(value))
+			m.energy += m.weights[c] * filtered * filtered
+		}
+
+		m.frames++
+
+		if m.frames == m.stepFrames {
+			m.stepEnergy = append(m.stepEnergy, m.energy)
+			m.frames = 0
+			m.energy = 0
+		}
+	}
+}
+
+// loudness returns the integrated loudness in LUFS, false if the samples are silent
+func (m *loudnessMeter) loudness() (float64, bool) {
+	steps := int(loudnessBlock / loudnessStep)
+	var blocks []float64
+
+	for i := steps; i <= len(m.stepEnergy); i++ {
+		energy := 0.0
+
+		for _, e := range m.stepEnergy[i-steps : i] {
+			energy += e
+		}
+
+		blocks = append(blocks, energy/float64(steps*m.stepFrames))
+	}
+
+	gated, ok := gatedEnergy(blocks, energyThreshold(absoluteGate))
+
+	if !ok {
+		return 0, false
+	}
+
+	// Relative gate depends on the loudness of the blocks above the absolute gate
+	gated, ok = gatedEnergy(blocks, gated*math.Pow(10, relativeGate/10.0))
+
+	if !ok {
+		return 0, false
+	}
+
+	return energyLoudness(gated), true
+}
+
+// gatedEnergy returns the mean energy of the blocks above the threshold
+func gatedEnergy(blocks []float64, threshold float64) (float64, bool) {
+	sum := 0.0
+	count := 0
+
+	for _, energy := range blocks {
+		if energy > threshold {
+			sum += energy
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0, false
+	}
+
+	return sum / float64(count), true
+}
+
+func energyLoudness(energy float64) float64 {
+	return -0.691 + 10*math.Log10(energy)
+}
+
+// energyThreshold converts a loudness to the mean energy of a block
+func energyThreshold(loudness float64) float64 {
+	return math.Pow(10, (loudness+0.691)/10)
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Metadata describes a music file
+type Metadata struct {
+	Title  string
+	Artist string
+	Album  string
+	// Length of the music (0 if unknown)
+	Duration time.Duration
+}
+
+// newMetadata reads the metadata from the tags,
+// files without title are named after the file
+func newMetadata(filePath string, tags Tags, duration time.Duration) Metadata {
+	metadata := Metadata{
+		Title:    tags["TITLE"],
+		Artist:   tags["ARTIST"],
+		Album:    tags["ALBUM"],
+		Duration: duration,
+	}
+
+	if metadata.Title == "" {
+		name := filepath.Base(filePath)
+		metadata.Title = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+
+	return metadata
+}
+
+func (m Metadata) String() string {
+	description := m.Title
+
+	if m.Artist != "" {
+		description = m.Artist + " - " + description
+	}
+
+	if m.Album != "" {
+		description += " (" + m.Album + ")"
+	}
+
+	return description
+}
@@ -17,17 +17,32 @@
 package audio
 
 import (
+	"errors"
 	"io"
+	"math"
 	"os"
-
-	mp3 "github.com/hajimehoshi/go-mp3"
+	"time"
 )
 
-const musicBufferSize = 512
+// Number of frames read at once
+const musicBufferFrames = 128
+
+// Longest time loading waits for the loudness of an unscanned file
+const scanWaitTimeout = time.Second * 3
 
 // Music is used to read samples from a music file
 type Music struct {
-	decoder *mp3.Decoder
+	decoder    Decoder
+	position   int64
+	outputRate int
+	format     Format
+	metadata   Metadata
+	gainMode   GainMode
+	scanner    *LoudnessScanner
+	gain       replayGain
+	normalized bool
+	mixer      *channelMixer
+	resampler  *Resampler
 }
 
 // NewMusic constructs a new music reader
@@ -35,35 +50,189 @@ func NewMusic() *Music {
 	return &Music{}
 }
 
-// Load loads a music file from a given path
-func (m *Music) Load(filePath string) (int, error) {
+// SetOutputRate resamples the music files to the given rate (0 keeps the rate of each file),
+// applies to the files loaded afterwards
+func (m *Music) SetOutputRate(sampleRate int) {
+	m.outputRate = sampleRate
+}
+
+// SetGainMode specifies how the loudness of the music files is normalized,
+// applies to the files loaded afterwards
+func (m *Music) SetGainMode(mode GainMode) {
+	m.gainMode = mode
+}
+
+// SetLoudnessScanner normalizes files without ReplayGain tags
+// using the loudness measured by the scanner
+func (m *Music) SetLoudnessScanner(scanner *LoudnessScanner) {
+	m.scanner = scanner
+}
+
+// Load loads a music file from a given path, returns the format of the read samples
+func (m *Music) Load(filePath string) (Format, error) {
+	// Previous music is replaced
+	if err := m.Close(); err != nil {
+		return Format{}, err
+	}
+
 	file, err := os.Open(filePath)
 
 	if err != nil {
-		return 0, err
+		return Format{}, err
 	}
 
-	m.decoder, err = mp3.NewDecoder(file)
+	decoder, err := NewDecoder(file)
 
 	if err != nil {
-		return 0, err
+		file.Close()
+
+		return Format{}, err
+	}
+
+	m.decoder = decoder
+	m.format = decoder.Format()
+	m.metadata = newMetadata(filePath, decoder.Tags(), m.toDuration(decoder.Length()))
+	m.gain, m.normalized = m.loadGain(filePath, decoder.Tags())
+
+	m.position = 0
+
+	if m.outputRate > 0 {
+		m.format.SampleRate = m.outputRate
+	}
+
+	m.updateMixer()
+	m.updateResampler()
+
+	return m.format, nil
+}
+
+// SetChannels mixes the samples of the loaded music to the given channel count,
+// returns the new format of the read samples
+func (m *Music) SetChannels(channels int) Format {
+	if m.decoder == nil {
+		return m.format
+	}
+
+	m.format.Channels = channels
+
+	m.updateMixer()
+	m.updateResampler()
+
+	return m.format
+}
+
+// loadGain reads the ReplayGain tags of the file or looks up its measured loudness,
+// files that weren't measured yet are scanned, long files only for the next time
+func (m *Music) loadGain(filePath string, tags Tags) (replayGain, bool) {
+	if m.gainMode == GainOff {
+		return replayGain{}, false
+	}
+
+	if gain, ok := tagReplayGain(tags, m.gainMode); ok {
+		return gain, true
+	}
+
+	if m.scanner == nil {
+		return replayGain{}, false
+	}
+
+	// Album loudness is unknown, tracks are normalized on their own
+	if result, ok := m.scanner.wait(filePath, scanWaitTimeout); ok && !result.Tagged {
+		return loudnessGain(result.Loudness, result.Peak), true
+	}
+
+	return replayGain{}, false
+}
+
+// Gain returns the gain (in dB) applied to the loaded music, false if it isn't normalized
+func (m *Music) Gain() (float64, bool) {
+	// Gain might be reduced to prevent clipping
+	return 20 * math.Log10(m.gain.factor()), m.normalized
+}
+
+// updateMixer mixes the channels of the file and applies the gain
+func (m *Music) updateMixer() {
+	m.mixer = newChannelMixer(m.decoder.Format().Channels, m.format.Channels)
+
+	if m.normalized {
+		m.mixer.scale(m.gain.factor())
+	}
+
+	if m.mixer.isIdentity() {
+		m.mixer = nil
+	}
+}
+
+// updateResampler converts the samples if the file has another sample rate
+func (m *Music) updateResampler() {
+	m.resampler = nil
+
+	if sampleRate := m.decoder.Format().SampleRate; sampleRate != m.format.SampleRate {
+		m.resampler = NewResampler(sampleRate, m.format.SampleRate, m.format.Channels)
 	}
+}
+
+// Format returns the format of the read samples
+func (m *Music) Format() Format {
+	return m.format
+}
 
-	return m.decoder.SampleRate(), nil
+// Metadata returns the title, artist, album and duration of the music file
+func (m *Music) Metadata() Metadata {
+	return m.metadata
 }
 
 // Read reads samples from the music file
 func (m *Music) Read() ([]byte, error) {
-	// Samples are 16 bit, 2 channels
-	samples := make([]byte, musicBufferSize)
-	frame := make([]byte, 4)
+	if m.decoder == nil {
+		return nil, errors.New("music is not loaded")
+	}
+
+	for {
+		samples, err := m.readFrames()
+
+		if err != nil {
+			return nil, err
+		}
+
+		ended := len(samples) < musicBufferFrames*m.decoder.Format().FrameSize()
+
+		if m.mixer != nil {
+			samples = m.mixer.mix(samples)
+		}
+
+		if m.resampler == nil {
+			return samples, nil
+		}
+
+		resampled := m.resampler.Resample(samples)
 
-	for i := 0; i < len(samples); i += 4 {
-		n, err := m.decoder.Read(frame)
+		// Held back samples are returned at the end of the music
+		if ended {
+			return append(resampled, m.resampler.Flush()...), nil
+		}
+
+		// Resampler holds back the first samples
+		if len(resampled) > 0 {
+			return resampled, nil
+		}
+	}
+}
+
+// readFrames reads samples in the format of the music file
+func (m *Music) readFrames() ([]byte, error) {
+	frameSize := m.decoder.Format().FrameSize()
+	samples := make([]byte, musicBufferFrames*frameSize)
+	frame := make([]byte, frameSize)
+
+	for i := 0; i < len(samples); i += frameSize {
+		n, err := io.ReadFull(m.decoder, frame)
 
 		if err != nil {
 			// Music reached the end
-			if err == io.EOF {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				m.position += int64(i / frameSize)
+
 				return samples[:i], nil
 			}
 
@@ -73,10 +242,73 @@ func (m *Music) Read() ([]byte, error) {
 		copy(samples[i:], frame[:n])
 	}
 
+	m.position += int64(len(samples) / frameSize)
+
 	return samples, nil
 }
 
+// Seek sets the read position of the music
+func (m *Music) Seek(position time.Duration) error {
+	if m.decoder == nil {
+		return errors.New("music is not loaded")
+	}
+
+	frame := m.toFrames(position)
+	length := m.decoder.Length()
+
+	if frame < 0 {
+		frame = 0
+	} else if length > 0 && frame > length {
+		frame = length
+	}
+
+	if err := m.decoder.SeekFrame(frame); err != nil {
+		return err
+	}
+
+	m.position = frame
+
+	if m.resampler != nil {
+		m.resampler.Reset()
+	}
+
+	return nil
+}
+
+// Position returns the read position of the music
+func (m *Music) Position() time.Duration {
+	if m.decoder == nil {
+		return 0
+	}
+
+	return m.toDuration(m.position)
+}
+
+// Length returns the length of the music (0 if unknown)
+func (m *Music) Length() time.Duration {
+	if m.decoder == nil {
+		return 0
+	}
+
+	return m.toDuration(m.decoder.Length())
+}
+
 // Close closes the music
 func (m *Music) Close() error {
-	return m.decoder.Close()
+	if m.decoder == nil {
+		return nil
+	}
+
+	err := m.decoder.Close()
+	m.decoder = nil
+
+	return err
+}
+
+func (m *Music) toFrames(duration time.Duration) int64 {
+	return m.decoder.Format().Frames(duration)
+}
+
+func (m *Music) toDuration(frames int64) time.Duration {
+	return m.decoder.Format().Duration(frames)
 }
@@ -17,45 +17,316 @@
 package audio
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/hajimehoshi/oto"
 )
 
 const playerBufferSize = 8192
 
+// Samples are mixed to stereo for the device
+const playerChannels = 2
+
+// MaxVolume is the volume the samples are played at without attenuation
+const MaxVolume = 100
+
 // Player is used to play music from samples
 type Player struct {
-	context *oto.Context
-	player  *oto.Player
+	context    *oto.Context
+	player     *oto.Player
+	format     Format
+	outputRate int
+	deviceRate int
+	channelMap ChannelMap
+	volume     int
+	muted      bool
+	mixer      *channelMixer
+	resampler  *Resampler
+	mutex      sync.Mutex
+	// Keeps the device player from being paused while writing
+	writeMutex sync.Mutex
+	paused     bool
 }
 
 // NewPlayer constructs a new music player
 func NewPlayer() *Player {
-	return &Player{}
+	return &Player{
+		volume: MaxVolume,
+	}
+}
+
+// SetOutputRate resamples the written samples to the given rate (0 plays them at their own rate),
+// applies when the player is prepared
+func (p *Player) SetOutputRate(sampleRate int) {
+	p.outputRate = sampleRate
+}
+
+// SetChannelMap specifies which channels are played on the speakers
+func (p *Player) SetChannelMap(mapping ChannelMap) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.channelMap = mapping
+
+	if p.format.Channels > 0 {
+		p.updateMixer()
+	}
+}
+
+// ChannelMap returns which channels are played on the speakers
+func (p *Player) ChannelMap() ChannelMap {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.channelMap
+}
+
+// SetVolume attenuates the samples (0 <= volume <= MaxVolume)
+func (p *Player) SetVolume(volume int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.volume = volume
+
+	if p.format.Channels > 0 {
+		p.updateMixer()
+	}
+}
+
+// Volume returns the volume the samples are played at
+func (p *Player) Volume() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.volume
+}
+
+// SetMuted plays silence instead of the samples, the volume is kept
+func (p *Player) SetMuted(muted bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.muted = muted
+
+	if p.format.Channels > 0 {
+		p.updateMixer()
+	}
 }
 
-// Prepare sets the sample rate of the player
-func (p *Player) Prepare(sampleRate int) error {
+// Muted checks if the player plays silence
+func (p *Player) Muted() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.muted
+}
+
+// Prepare sets the format of the written samples
+func (p *Player) Prepare(format Format) error {
+	if err := checkPlayerFormat(format); err != nil {
+		return err
+	}
+
 	var err error
 
-	// Context with 16 bit PCM, 2 channels
-	p.context, err = oto.NewContext(sampleRate, 2, 2, playerBufferSize)
+	deviceRate := format.SampleRate
+
+	if p.outputRate > 0 {
+		deviceRate = p.outputRate
+	}
+
+	// Context with 16 bit PCM
+	p.context, err = oto.NewContext(deviceRate, playerChannels, BitDepth/8, playerBufferSize)
 
 	if err != nil {
 		return err
 	}
 
+	p.writeMutex.Lock()
 	p.player = p.context.NewPlayer()
+	p.paused = false
+	p.writeMutex.Unlock()
+
+	p.deviceRate = deviceRate
+	p.setFormat(format)
 
 	return nil
 }
 
+// ChangeFormat changes the format of the written samples,
+// the player is only recreated if it doesn't resample to a fixed rate
+func (p *Player) ChangeFormat(format Format) error {
+	if p.outputRate == 0 && format.SampleRate != p.format.SampleRate {
+		if err := p.Close(); err != nil {
+			return err
+		}
+
+		return p.Prepare(format)
+	}
+
+	if err := checkPlayerFormat(format); err != nil {
+		return err
+	}
+
+	// Held back samples of the previous format are played first
+	if p.resampler != nil {
+		if err := p.writeDevice(p.resampler.Flush()); err != nil {
+			return err
+		}
+	}
+
+	p.setFormat(format)
+
+	return nil
+}
+
+func checkPlayerFormat(format Format) error {
+	if format.BitDepth != BitDepth {
+		return fmt.Errorf("samples with %d bits are not supported", format.BitDepth)
+	}
+
+	return CheckChannels(format.Channels)
+}
+
+func (p *Player) setFormat(format Format) {
+	p.mutex.Lock()
+	p.format = format
+	p.updateMixer()
+	p.mutex.Unlock()
+
+	p.resampler = nil
+
+	if format.SampleRate != p.deviceRate {
+		p.resampler = NewResampler(format.SampleRate, p.deviceRate, playerChannels)
+	}
+}
+
+// updateMixer mixes the channels of the samples to stereo,
+// applies the channel map and the volume
+func (p *Player) updateMixer() {
+	p.mixer = newMappedMixer(p.format.Channels, p.channelMap)
+	p.mixer.scale(p.gain())
+
+	if p.mixer.isIdentity() {
+		p.mixer = nil
+	}
+}
+
+// gain converts the volume to the factor the samples are multiplied with
+func (p *Player) gain() float64 {
+	if p.muted {
+		return 0
+	}
+
+	// Cubic curve approximates the perceived loudness
+	volume := float64(p.volume) / MaxVolume
+
+	return volume * volume * volume
+}
+
+// Format returns the format of the written samples
+func (p *Player) Format() Format {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.format
+}
+
+// Latency returns the time it takes for written samples to be played
+func (p *Player) Latency() time.Duration {
+	if p.deviceRate == 0 {
+		return 0
+	}
+
+	// Player buffer holds 16 bit, stereo samples
+	frames := playerBufferSize / (playerChannels * BitDepth / 8)
+	latency := time.Duration(frames) * time.Second / time.Duration(p.deviceRate)
+
+	if p.resampler != nil {
+		latency += p.resampler.Delay()
+	}
+
+	return latency
+}
+
 // Write writes the given samples to the player
 func (p *Player) Write(samples []byte) (int, error) {
 	if p.player == nil {
 		return 0, nil
 	}
 
-	return p.player.Write(samples)
+	p.mutex.Lock()
+	mixer := p.mixer
+	p.mutex.Unlock()
+
+	converted := samples
+
+	if mixer != nil {
+		converted = mixer.mix(converted)
+	}
+
+	if p.resampler != nil {
+		converted = p.resampler.Resample(converted)
+	}
+
+	if err := p.writeDevice(converted); err != nil {
+		return 0, err
+	}
+
+	return len(samples), nil
+}
+
+// writeDevice writes the converted samples, they are discarded while paused
+func (p *Player) writeDevice(samples []byte) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	if p.paused {
+		return nil
+	}
+
+	_, err := p.player.Write(samples)
+
+	return err
+}
+
+// Pause stops playing samples without closing the device,
+// the device plays silence until the player is resumed
+func (p *Player) Pause() error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	if p.player == nil || p.paused {
+		return nil
+	}
+
+	p.paused = true
+
+	return p.player.Close()
+}
+
+// Resume plays the samples written after resuming,
+// they start once the samples in the device's buffer have been played
+func (p *Player) Resume() {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	if !p.paused {
+		return
+	}
+
+	p.player = p.context.NewPlayer()
+	p.paused = false
+}
+
+// Flush discards the samples held back by the resampler,
+// samples already written to the device are still played
+func (p *Player) Flush() {
+	if p.resampler != nil {
+		p.resampler.Reset()
+	}
 }
 
 // Close closes the player
@@ -65,7 +336,9 @@ func (p *Player) Close() error {
 	}
 
 	// Ignore errors, close context anyways
+	p.writeMutex.Lock()
 	p.player.Close()
+	p.writeMutex.Unlock()
 
 	return p.context.Close()
 }
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Loudness the tracks are normalized to (ReplayGain 2.0)
+const referenceLoudness = -18
+
+// GainMode specifies how the loudness of the tracks is normalized
+type GainMode int
+
+const (
+	// GainOff plays the tracks unchanged
+	GainOff GainMode = iota
+	// GainTrack normalizes each track on its own
+	GainTrack
+	// GainAlbum keeps the loudness differences between the tracks of an album
+	GainAlbum
+)
+
+var gainModeNames = []string{"off", "track", "album"}
+
+// ParseGainMode returns the gain mode with the given name
+func ParseGainMode(name string) (GainMode, error) {
+	for i, modeName := range gainModeNames {
+		if strings.EqualFold(name, modeName) {
+			return GainMode(i), nil
+		}
+	}
+
+	return GainOff, fmt.Errorf("unknown gain mode '%s'", name)
+}
+
+func (m GainMode) String() string {
+	return gainModeNames[m]
+}
+
+// replayGain is the gain (in dB) and the peak of a track or album
+type replayGain struct {
+	gain float64
+	peak float64
+}
+
+// tagReplayGain reads the ReplayGain tags, album gain falls back to the track gain
+func tagReplayGain(tags Tags, mode GainMode) (replayGain, bool) {
+	gainTag, peakTag := "REPLAYGAIN_TRACK_GAIN", "REPLAYGAIN_TRACK_PEAK"
+
+	if _, ok := tags["REPLAYGAIN_ALBUM_GAIN"]; ok && mode == GainAlbum {
+		gainTag, peakTag = "REPLAYGAIN_ALBUM_GAIN", "REPLAYGAIN_ALBUM_PEAK"
+	}
+
+	// Gain is given in dB (e.g. "-6.5 dB")
+	gain, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(
+		strings.ToLower(tags[gainTag]), "db")), 64)
+
+	if err != nil || math.IsNaN(gain) || math.IsInf(gain, 0) {
+		return replayGain{}, false
+	}
+
+	// Peak is unknown if missing
+	peak, err := strconv.ParseFloat(strings.TrimSpace(tags[peakTag]), 64)
+
+	if err != nil || math.IsNaN(peak) || peak <= 0 {
+		peak = 0
+	}
+
+	return replayGain{gain, peak}, true
+}
+
+// loudnessGain returns the gain that normalizes a measured loudness
+func loudnessGain(loudness float64, peak float64) replayGain {
+	return replayGain{referenceLoudness - loudness, peak}
+}
+
+// factor converts the gain to the factor the samples are multiplied with,
+// the peak is kept from clipping
+func (g replayGain) factor() float64 {
+	factor := math.Pow(10, g.gain/20)
+
+	if g.peak > 0 && factor*g.peak > 1 {
+		factor = 1 / g.peak
+	}
+
+	return factor
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Zero crossings on each side of the filter, more are sharper but slower
+	resamplerZeroCrossings = 32
+	// Filter values per zero crossing, interpolated linearly in between
+	resamplerResolution = 256
+	// Passband relative to the lower Nyquist frequency, the rest is used for rolling off
+	resamplerBandwidth = 0.95
+	// Shape of the Kaiser window (about 80 dB stopband attenuation)
+	resamplerKaiserBeta = 8
+)
+
+// Filter is the same for all resamplers
+var resamplerFilter = newResamplerFilter()
+
+// Resampler converts 16 bit samples to another sample rate
+// using band-limited (windowed sinc) interpolation
+type Resampler struct {
+	inputRate  int
+	outputRate int
+	channels   int
+	// Input frames per output frame
+	step float64
+	// Filter is stretched when downsampling to remove frequencies above the new Nyquist frequency
+	scale float64
+	// Number of input frames on each side of an output frame
+	width int
+	// Input frames that are still needed, interleaved
+	frames []float64
+	// Position of the next output frame within the input frames
+	time float64
+}
+
+// NewResampler constructs a resampler for samples with the given channel count
+func NewResampler(inputRate int, outputRate int, channels int) *Resampler {
+	scale := resamplerBandwidth
+
+	if outputRate < inputRate {
+		scale *= float64(outputRate) / float64(inputRate)
+	}
+
+	r := &Resampler{
+		inputRate:  inputRate,
+		outputRate: outputRate,
+		channels:   channels,
+		step:       float64(inputRate) / float64(outputRate),
+		scale:      scale,
+		width:      int(math.Ceil(resamplerZeroCrossings / scale)),
+	}
+	r.Reset()
+
+	return r
+}
+
+// InputRate returns the sample rate of the converted samples
+func (r *Resampler) InputRate() int {
+	return r.inputRate
+}
+
+// OutputRate returns the sample rate of the resampled samples
+func (r *Resampler) OutputRate() int {
+	return r.outputRate
+}
+
+// Delay returns the time samples are held back until enough of the following ones are known
+func (r *Resampler) Delay() time.Duration {
+	return time.Duration(r.width) * time.Second / time.Duration(r.inputRate)
+}
+
+// Resample converts the samples, the last ones are held back until more samples follow
+func (r *Resampler) Resample(samples []byte) []byte {
+	// Incomplete frames are ignored
+	length := len(samples) - len(samples)%(r.channels*2)
+
+	for i := 0; i < length; i += 2 {
+		r.frames = append(r.frames, float64(int16(samples[i])|int16(samples[i+1])<<8))
+	}
+
+	return r.convert()
+}
+
+// Flush returns the held back samples, followed by silence instead of further samples
+func (r *Resampler) Flush() []byte {
+	r.frames = append(r.frames, make([]float64, r.width*r.channels)...)
+	samples := r.convert()
+	r.Reset()
+
+	return samples
+}
+
+// Reset discards the held back samples, e.g. after seeking
+func (r *Resampler) Reset() {
+	// Samples before the first one are silent
+	r.frames = make([]float64, r.width*r.channels)
+	r.time = float64(r.width)
+}
+
+// convert interpolates all output frames whose surrounding input frames are known
+func (r *Resampler) convert() []byte {
+	count := len(r.frames) / r.channels
+	samples := make([]byte, 0, int(float64(count)/r.step+1)*r.channels*2)
+	values := make([]float64, r.channels)
+
+	for int(r.time)+r.width < count {
+		for c := range values {
+			values[c] = 0
+		}
+
+		center := int(r.time)
+
+		for i := center - r.width + 1; i <= center+r.width; i++ {
+			weight := r.scale * resamplerFilter.value((r.time-float64(i))*r.scale)
+
+			if weight == 0 {
+				continue
+			}
+
+			frame := r.frames[i*r.channels:]
+
+			for c := range values {
+				values[c] += frame[c] * weight
+			}
+		}
+
+		for _, value := range values {
+			sample := roundSample(value)
+			samples = append(samples, byte(sample), byte(sample>>8))
+		}
+
+		r.time += r.step
+	}
+
+	// Discard input frames that are no longer needed
+	if unused := int(r.time) - r.width + 1; unused > 0 {
+		r.frames = append(r.frames[:0], r.frames[unused*r.channels:]...)
+		r.time -= float64(unused)
+	}
+
+	return samples
+}
+
+// roundSample converts an interpolated value to a 16 bit sample
+func roundSample(value float64) int16 {
+	if value >= 32767 {
+		return 32767
+	}
+
+	if value <= -32768 {
+		return -32768
+	}
+
+	return int16(math.Round(value))
+}
+
+// resamplerFilterTable holds one side of the windowed sinc function
+type resamplerFilterTable []float64
+
+func newResamplerFilter() resamplerFilterTable {
+	table := make(resamplerFilterTable, resamplerZeroCrossings*resamplerResolution+2)
+	window := besselI0(resamplerKaiserBeta)
+
+	for i := range table {
+		x := float64(i) / resamplerResolution
+
+		if x >= resamplerZeroCrossings {
+			break
+		}
+
+		// Kaiser window limits the sinc function to the zero crossings
+		ratio := x / resamplerZeroCrossings
+		table[i] = sinc(x) * besselI0(resamplerKaiserBeta*math.Sqrt(1-ratio*ratio)) / window
+	}
+
+	return table
+}
+
+// value returns the filter at the given distance (in zero crossings)
+func (t resamplerFilterTable) value(x float64) float64 {
+	position := math.Abs(x) * resamplerResolution
+	index := int(position)
+
+	if index >= len(t)-1 {
+		return 0
+	}
+
+	fraction := position - float64(index)
+
+	return t[index] + (t[index+1]-t[index])*fraction
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// besselI0 is the modified Bessel function of the first kind (order 0) used by the Kaiser window
+func besselI0(x float64) float64 {
+	sum := 1.0
+	term := 1.0
+
+	for k := 1; term > sum*1e-12; k++ {
+		term *= (x / 2 / float64(k)) * (x / 2 / float64(k))
+		sum += term
+	}
+
+	return sum
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+var resamplerRates = []struct {
+	input  int
+	output int
+}{
+	{44100, 48000},
+	{48000, 44100},
+	{22050, 48000},
+	{48000, 8000},
+	{8000, 192000},
+	{48000, 48000},
+}
+
+// resample converts the samples in chunks of varying size and flushes the resampler
+func resample(resampler *Resampler, samples []byte, chunkFrames []int) []byte {
+	frameSize := resampler.channels * 2
+	resampled := make([]byte, 0)
+
+	for i := 0; len(samples) > 0; i++ {
+		size := chunkFrames[i%len(chunkFrames)] * frameSize
+
+		if size > len(samples) {
+			size = len(samples)
+		}
+
+		resampled = append(resampled, resampler.Resample(samples[:size])...)
+		samples = samples[size:]
+	}
+
+	return append(resampled, resampler.Flush()...)
+}
+
+// Output has the length of the input at the new rate, regardless of the chunk boundaries
+func TestResamplerLength(t *testing.T) {
+	const inputFrames = 10000
+
+	samples := testSamples(inputFrames, 2, sine)
+
+	for _, rates := range resamplerRates {
+		whole := resample(NewResampler(rates.input, rates.output, 2), samples, []int{inputFrames})
+		frames := len(whole) / 4
+		expected := inputFrames * rates.output / rates.input
+
+		// Last frame depends on the rounding of the position
+		if frames < expected-1 || frames > expected+1 {
+			t.Errorf("%d to %d Hz: expected %d frames, got %d", rates.input, rates.output, expected, frames)
+		}
+
+		chunked := resample(NewResampler(rates.input, rates.output, 2), samples, []int{441, 1, 1000, 37, 480})
+
+		if !bytes.Equal(whole, chunked) {
+			t.Errorf("%d to %d Hz: samples resampled in chunks differ", rates.input, rates.output)
+		}
+	}
+}
+
+// Frequencies in the passband are kept, the left channel holds a sine and the right one a DC offset
+func TestResamplerPassthrough(t *testing.T) {
+	const (
+		frequency = 1000
+		amplitude = 20000
+		offset    = -10000
+		// Largest deviation from the ideal samples
+		tolerance = 4
+	)
+
+	for _, rates := range resamplerRates {
+		inputFrames := rates.input / 4
+		samples := testSamples(inputFrames, 2, func(i int, c int) int16 {
+			if c == 1 {
+				return offset
+			}
+
+			return int16(math.Round(amplitude * math.Sin(2*math.Pi*frequency*float64(i)/float64(rates.input))))
+		})
+
+		resampler := NewResampler(rates.input, rates.output, 2)
+		resampled := resample(resampler, samples, []int{1000})
+		frames := len(resampled) / 4
+
+		// Samples at the edges are filtered with the silence around them
+		edge := resampler.width * rates.output / rates.input
+		maxError := 0.0
+
+		for i := edge; i < frames-edge; i++ {
+			left := float64(int16(binary.LittleEndian.Uint16(resampled[i*4:])))
+			right := float64(int16(binary.LittleEndian.Uint16(resampled[i*4+2:])))
+			expected := amplitude * math.Sin(2*math.Pi*frequency*float64(i)/float64(rates.output))
+
+			maxError = math.Max(maxError, math.Max(math.Abs(left-expected), math.Abs(right-offset)))
+		}
+
+		if maxError > tolerance {
+			t.Errorf("%d to %d Hz: samples deviate by %.1f", rates.input, rates.output, maxError)
+		}
+	}
+}
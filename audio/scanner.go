@@ -0,0 +1,352 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of frames measured at once
+	scanBufferFrames = 4096
+	// Number of files waiting to be scanned
+	scanQueueSize = 1024
+)
+
+var errScanStopped = errors.New("scanner was closed")
+
+// ScanCallback is called after a file was scanned, tagged files are skipped
+type ScanCallback func(filePath string, loudness float64, err error)
+
+// scanResult is the cached loudness of a file, valid while its size and time stay the same
+type scanResult struct {
+	Size     int64   `json:"size"`
+	Modified int64   `json:"modified"`
+	Loudness float64 `json:"loudness"`
+	Peak     float64 `json:"peak"`
+	// File has ReplayGain tags and wasn't scanned
+	Tagged bool `json:"tagged,omitempty"`
+}
+
+// LoudnessScanner measures the loudness of untagged files in the background,
+// the results are cached in a file
+type LoudnessScanner struct {
+	cachePath string
+	callback  ScanCallback
+	results   map[string]*scanResult
+	queued    map[string]bool
+	// Files being scanned, their channels are closed once they are done
+	scanning  map[string]chan bool
+	pending   chan string
+	done      chan bool
+	closeOnce sync.Once
+	mutex     sync.Mutex
+}
+
+// NewLoudnessScanner loads the cached results and starts scanning queued files
+func NewLoudnessScanner(cachePath string, callback ScanCallback) (*LoudnessScanner, error) {
+	s := &LoudnessScanner{
+		cachePath: cachePath,
+		callback:  callback,
+		results:   make(map[string]*scanResult),
+		queued:    make(map[string]bool),
+		scanning:  make(map[string]chan bool),
+		pending:   make(chan string, scanQueueSize),
+		done:      make(chan bool),
+	}
+
+	data, err := ioutil.ReadFile(cachePath)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(data, &s.results); err != nil {
+			return nil, err
+		}
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// Queue scans the file unless it was scanned already
+func (s *LoudnessScanner) Queue(filePath string) {
+	path, err := filepath.Abs(filePath)
+
+	if err != nil {
+		return
+	}
+
+	if _, ok := s.result(path); ok {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.queued[path] {
+		return
+	}
+
+	// Files are queued again when the queue is full
+	select {
+	case s.pending <- path:
+		s.queued[path] = true
+	default:
+	}
+}
+
+// result returns the cached result if the file hasn't changed
+func (s *LoudnessScanner) result(filePath string) (*scanResult, bool) {
+	path, err := filepath.Abs(filePath)
+
+	if err != nil {
+		return nil, false
+	}
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return nil, false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result, ok := s.results[path]
+
+	if !ok || result.Size != info.Size() || result.Modified != info.ModTime().UnixNano() {
+		return nil, false
+	}
+
+	return result, true
+}
+
+// wait scans the file immediately unless it was scanned already,
+// returns false if the scan doesn't finish within the timeout
+func (s *LoudnessScanner) wait(filePath string, timeout time.Duration) (*scanResult, bool) {
+	path, err := filepath.Abs(filePath)
+
+	if err != nil {
+		return nil, false
+	}
+
+	if result, ok := s.result(path); ok {
+		return result, true
+	}
+
+	// Queued file is scanned before its turn
+	scanned, started := s.beginScan(path)
+
+	if started {
+		go s.scanFile(path, scanned)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-scanned:
+		return s.result(path)
+	case <-timer.C:
+	case <-s.done:
+	}
+
+	return nil, false
+}
+
+func (s *LoudnessScanner) run() {
+	for {
+		select {
+		case path := <-s.pending:
+			// File was scanned for a waiting track in the meantime
+			if _, ok := s.result(path); ok {
+				continue
+			}
+
+			scanned, started := s.beginScan(path)
+
+			// File is still being scanned for a waiting track
+			if !started {
+				continue
+			}
+
+			if err := s.scanFile(path, scanned); err == errScanStopped {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// beginScan marks the file as being scanned,
+// returns false with the channel of the running scan if it already is
+func (s *LoudnessScanner) beginScan(path string) (chan bool, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if scanned, ok := s.scanning[path]; ok {
+		return scanned, false
+	}
+
+	scanned := make(chan bool)
+	s.scanning[path] = scanned
+
+	return scanned, true
+}
+
+// scanFile scans the file and caches the result, closing the channel afterwards
+func (s *LoudnessScanner) scanFile(path string, scanned chan bool) error {
+	result, err := s.scan(path)
+
+	s.mutex.Lock()
+	delete(s.queued, path)
+	delete(s.scanning, path)
+
+	if err == nil {
+		s.results[path] = result
+		err = s.save()
+	}
+
+	s.mutex.Unlock()
+	close(scanned)
+
+	if err == errScanStopped || s.callback == nil {
+		return err
+	}
+
+	if err != nil {
+		s.callback(path, 0, err)
+	} else if !result.Tagged {
+		s.callback(path, result.Loudness, nil)
+	}
+
+	return err
+}
+
+// scan measures the loudness of the file
+func (s *LoudnessScanner) scan(path string) (*scanResult, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	decoder, err := NewDecoder(file)
+
+	if err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	defer decoder.Close()
+
+	result := &scanResult{
+		Size:     info.Size(),
+		Modified: info.ModTime().UnixNano(),
+	}
+
+	if _, ok := tagReplayGain(decoder.Tags(), GainTrack); ok {
+		result.Tagged = true
+
+		return result, nil
+	}
+
+	format := decoder.Format()
+	meter := newLoudnessMeter(format)
+	buffer := make([]byte, scanBufferFrames*format.FrameSize())
+
+	for {
+		select {
+		case <-s.done:
+			return nil, errScanStopped
+		default:
+		}
+
+		n, err := io.ReadFull(decoder, buffer)
+		meter.add(buffer[:n])
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	loudness, ok := meter.loudness()
+
+	// Silent files are played unchanged
+	if !ok {
+		loudness = referenceLoudness
+	}
+
+	result.Loudness = loudness
+	result.Peak = meter.peak
+
+	return result, nil
+}
+
+// save writes the results to the cache file
+func (s *LoudnessScanner) save() error {
+	data, err := json.Marshal(s.results)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.cachePath), 0755); err != nil {
+		return err
+	}
+
+	// Cache isn't corrupted if writing fails
+	temp := s.cachePath + ".tmp"
+
+	if err := ioutil.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(temp, s.cachePath)
+}
+
+// Close stops scanning, the current file is discarded
+func (s *LoudnessScanner) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
@@ -0,0 +1,356 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// Size of the ID3v2 header and of each frame header
+	id3HeaderSize = 10
+	// Largest ID3v2 tag that is read, bigger ones mostly contain pictures
+	maxID3Size = 1 << 20
+	// Size of the ID3v1 tag at the end of the file
+	id3v1Size = 128
+)
+
+// Names of the ID3v2 text frames that describe the track
+var id3TextFrames = map[string]string{
+	"TIT2": "TITLE",
+	"TPE1": "ARTIST",
+	"TALB": "ALBUM",
+	// Version 2.2
+	"TT2": "TITLE",
+	"TP1": "ARTIST",
+	"TAL": "ALBUM",
+}
+
+// Names of the RIFF INFO chunks that describe the track
+var riffInfoChunks = map[string]string{
+	"INAM": "TITLE",
+	"IART": "ARTIST",
+	"IPRD": "ALBUM",
+}
+
+// Tags holds the metadata of a music file, names are uppercase (e.g. "REPLAYGAIN_TRACK_GAIN")
+type Tags map[string]string
+
+// parseComments reads Vorbis comments ("NAME=value"), the first value of a name is kept
+func parseComments(comments []string) Tags {
+	tags := make(Tags)
+
+	for _, comment := range comments {
+		parts := strings.SplitN(comment, "=", 2)
+
+		if len(parts) < 2 {
+			continue
+		}
+
+		tags.add(parts[0], parts[1])
+	}
+
+	return tags
+}
+
+func (t Tags) add(name string, value string) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	value = strings.TrimSpace(value)
+
+	if _, ok := t[name]; ok || name == "" || value == "" {
+		return
+	}
+
+	t[name] = value
+}
+
+// readID3v2 reads the user-defined (TXXX) and the title, artist and album text frames
+// of the ID3v2 tag at the beginning of the file, files without tag have no tags
+func readID3v2(reader io.ReaderAt) Tags {
+	tags := make(Tags)
+	header := make([]byte, id3HeaderSize)
+
+	if _, err := reader.ReadAt(header, 0); err != nil || !bytes.HasPrefix(header, []byte("ID3")) {
+		return tags
+	}
+
+	version := header[3]
+	flags := header[5]
+	size := syncsafeInt(header[6:10])
+
+	if version < 2 || version > 4 || size > maxID3Size {
+		return tags
+	}
+
+	data := make([]byte, size)
+
+	if _, err := reader.ReadAt(data, id3HeaderSize); err != nil {
+		return tags
+	}
+
+	// Version 2.4 marks unsynchronised frames separately
+	if flags&0x80 != 0 && version < 4 {
+		data = resynchronise(data)
+	}
+
+	// Extended header is skipped
+	if flags&0x40 != 0 && version > 2 && len(data) >= 4 {
+		extendedSize := int(binary.BigEndian.Uint32(data)) + 4
+
+		if version == 4 {
+			extendedSize = syncsafeInt(data[:4])
+		}
+
+		if extendedSize > len(data) {
+			return tags
+		}
+
+		data = data[extendedSize:]
+	}
+
+	for len(data) > 0 {
+		id, frame, rest, ok := nextID3Frame(data, version)
+
+		if !ok {
+			break
+		}
+
+		data = rest
+
+		if id == "TXXX" || id == "TXX" {
+			parts := decodeID3Strings(frame)
+
+			if len(parts) >= 2 {
+				tags.add(parts[0], parts[1])
+			}
+		} else if name, ok := id3TextFrames[id]; ok {
+			// Version 2.4 separates multiple values, only the first is kept
+			if parts := decodeID3Strings(frame); len(parts) > 0 {
+				tags.add(name, parts[0])
+			}
+		}
+	}
+
+	return tags
+}
+
+// readID3v1 reads the title, artist and album of the ID3v1 tag at the end of the file
+func readID3v1(reader io.ReaderAt, fileSize int64) Tags {
+	tags := make(Tags)
+	tag := make([]byte, id3v1Size)
+
+	if fileSize < id3v1Size {
+		return tags
+	}
+
+	if _, err := reader.ReadAt(tag, fileSize-id3v1Size); err != nil || !bytes.HasPrefix(tag, []byte("TAG")) {
+		return tags
+	}
+
+	// Fields have a fixed size and are padded with null bytes or spaces
+	tags.add("TITLE", decodeLatin1(bytes.TrimRight(tag[3:33], "\x00")))
+	tags.add("ARTIST", decodeLatin1(bytes.TrimRight(tag[33:63], "\x00")))
+	tags.add("ALBUM", decodeLatin1(bytes.TrimRight(tag[63:93], "\x00")))
+
+	return tags
+}
+
+// parseRiffInfo reads the title, artist and album of a RIFF INFO list
+func parseRiffInfo(list []byte) Tags {
+	tags := make(Tags)
+
+	if !bytes.HasPrefix(list, []byte("INFO")) {
+		return tags
+	}
+
+	data := list[4:]
+
+	for len(data) >= 8 {
+		id := string(data[:4])
+		size := int(binary.LittleEndian.Uint32(data[4:]))
+		data = data[8:]
+
+		if size > len(data) {
+			break
+		}
+
+		if name, ok := riffInfoChunks[id]; ok {
+			tags.add(name, string(bytes.TrimRight(data[:size], "\x00")))
+		}
+
+		// Chunks are padded to an even size
+		if size%2 == 1 && size < len(data) {
+			size++
+		}
+
+		data = data[size:]
+	}
+
+	return tags
+}
+
+// nextID3Frame splits the first frame off the data
+func nextID3Frame(data []byte, version byte) (string, []byte, []byte, bool) {
+	// Version 2.2 uses three byte IDs and sizes without flags
+	idSize, headerSize := 4, id3HeaderSize
+
+	if version == 2 {
+		idSize, headerSize = 3, 6
+	}
+
+	// Rest of the tag is padding
+	if len(data) < headerSize || data[0] == 0 {
+		return "", nil, nil, false
+	}
+
+	id := string(data[:idSize])
+	var size int
+	var flags uint16
+
+	switch version {
+	case 2:
+		size = int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+	case 3:
+		size = int(binary.BigEndian.Uint32(data[4:]))
+		flags = binary.BigEndian.Uint16(data[8:])
+	default:
+		size = syncsafeInt(data[4:8])
+		flags = binary.BigEndian.Uint16(data[8:])
+	}
+
+	if size > len(data)-headerSize {
+		return "", nil, nil, false
+	}
+
+	frame := data[headerSize : headerSize+size]
+	rest := data[headerSize+size:]
+
+	// Compressed and encrypted frames are skipped
+	if version == 3 && flags&0xc0 != 0 || version == 4 && flags&0x0c != 0 {
+		return id, nil, rest, true
+	}
+
+	if version == 4 {
+		// Data length indicator precedes the frame
+		if flags&0x01 != 0 && len(frame) >= 4 {
+			frame = frame[4:]
+		}
+
+		if flags&0x02 != 0 {
+			frame = resynchronise(frame)
+		}
+	}
+
+	return id, frame, rest, true
+}
+
+// decodeID3Strings decodes the null-separated strings of a text frame
+func decodeID3Strings(frame []byte) []string {
+	if len(frame) == 0 {
+		return nil
+	}
+
+	encoding := frame[0]
+	data := frame[1:]
+	var strs []string
+
+	// UTF-16 strings are terminated by two null bytes
+	if encoding == 1 || encoding == 2 {
+		var start int
+
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				strs = append(strs, decodeUTF16(data[start:i], encoding == 2))
+				start = i + 2
+			}
+		}
+
+		if start < len(data) {
+			strs = append(strs, decodeUTF16(data[start:], encoding == 2))
+		}
+
+		return strs
+	}
+
+	for _, part := range bytes.Split(data, []byte{0}) {
+		if encoding == 0 {
+			strs = append(strs, decodeLatin1(part))
+		} else {
+			strs = append(strs, string(part))
+		}
+	}
+
+	return strs
+}
+
+// decodeLatin1 decodes an ISO-8859-1 string, which matches the first code points of Unicode
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+
+	return string(runes)
+}
+
+// decodeUTF16 decodes a string with byte order mark, bigEndian is used without
+func decodeUTF16(data []byte, bigEndian bool) string {
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+		bigEndian = false
+		data = data[2:]
+	} else if len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff {
+		bigEndian = true
+		data = data[2:]
+	}
+
+	units := make([]uint16, len(data)/2)
+
+	for i := range units {
+		if bigEndian {
+			units[i] = binary.BigEndian.Uint16(data[i*2:])
+		} else {
+			units[i] = binary.LittleEndian.Uint16(data[i*2:])
+		}
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// resynchronise removes the null bytes inserted after each 0xff
+func resynchronise(data []byte) []byte {
+	result := make([]byte, 0, len(data))
+
+	for i := 0; i < len(data); i++ {
+		result = append(result, data[i])
+
+		if data[i] == 0xff && i+1 < len(data) && data[i+1] == 0 {
+			i++
+		}
+	}
+
+	return result
+}
+
+// syncsafeInt decodes an integer with 7 bits per byte
+func syncsafeInt(data []byte) int {
+	return int(data[0])<<21 | int(data[1])<<14 | int(data[2])<<7 | int(data[3])
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// Number of frames decoded at once
+const vorbisFramesPerRead = 1024
+
+// Vorbis channel of each channel in the WAV order
+var vorbisChannelOrder = [MaxChannels + 1][]int{
+	1: {0},
+	2: {0, 1},
+	3: {0, 2, 1},
+	4: {0, 1, 2, 3},
+	5: {0, 2, 1, 3, 4},
+	6: {0, 2, 1, 5, 3, 4},
+	7: {0, 2, 1, 6, 5, 3, 4},
+	8: {0, 2, 1, 7, 5, 6, 3, 4},
+}
+
+type vorbisDecoder struct {
+	pcmBuffer
+	file   *os.File
+	reader *oggvorbis.Reader
+	frames []float32
+}
+
+func matchVorbis(signature []byte) bool {
+	return bytes.HasPrefix(signature, []byte("OggS"))
+}
+
+func newVorbisDecoder(file *os.File) (Decoder, error) {
+	reader, err := oggvorbis.NewReader(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := &vorbisDecoder{
+		file:   file,
+		reader: reader,
+		frames: make([]float32, vorbisFramesPerRead*reader.Channels()),
+	}
+	d.fill = d.decodeFrames
+	d.format = Format{
+		SampleRate: reader.SampleRate(),
+		Channels:   reader.Channels(),
+		BitDepth:   BitDepth,
+	}
+	d.tags = parseComments(reader.CommentHeader().Comments)
+
+	return d, nil
+}
+
+func (d *vorbisDecoder) Read(buffer []byte) (int, error) {
+	return d.read(buffer)
+}
+
+func (d *vorbisDecoder) Length() int64 {
+	return d.reader.Length()
+}
+
+func (d *vorbisDecoder) SeekFrame(frame int64) error {
+	d.reset(0)
+
+	return d.reader.SetPosition(frame)
+}
+
+func (d *vorbisDecoder) Close() error {
+	return d.file.Close()
+}
+
+func (d *vorbisDecoder) decodeFrames() error {
+	n, err := d.reader.Read(d.frames)
+
+	if n == 0 {
+		return err
+	}
+
+	channels := d.reader.Channels()
+
+	order := vorbisChannelOrder[channels]
+
+	for i := 0; i < n; i += channels {
+		for _, channel := range order {
+			d.appendSample(floatToSample(float64(d.frames[i+channel])))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatExtensible = 0xfffe
+)
+
+// Number of frames decoded at once
+const wavFramesPerRead = 1024
+
+// Largest metadata list that is read
+const maxWavInfoSize = 1 << 16
+
+type wavDecoder struct {
+	pcmBuffer
+	file       *os.File
+	data       io.Reader
+	dataOffset int64
+	dataSize   int64
+	sampleRate int
+	channels   int
+	bitDepth   int
+	float      bool
+	frames     []byte
+}
+
+func matchWav(signature []byte) bool {
+	return len(signature) >= 12 &&
+		bytes.Equal(signature[:4], []byte("RIFF")) &&
+		bytes.Equal(signature[8:12], []byte("WAVE"))
+}
+
+func newWavDecoder(file *os.File) (Decoder, error) {
+	d := &wavDecoder{
+		file: file,
+	}
+	d.fill = d.decodeFrames
+
+	if err := d.parseHeader(bufio.NewReader(file)); err != nil {
+		return nil, err
+	}
+
+	if err := d.SeekFrame(0); err != nil {
+		return nil, err
+	}
+
+	d.frames = make([]byte, wavFramesPerRead*d.frameSize())
+	d.format = Format{
+		SampleRate: d.sampleRate,
+		Channels:   d.channels,
+		BitDepth:   BitDepth,
+	}
+
+	return d, nil
+}
+
+func (d *wavDecoder) Read(buffer []byte) (int, error) {
+	return d.read(buffer)
+}
+
+func (d *wavDecoder) Length() int64 {
+	return d.dataSize / int64(d.frameSize())
+}
+
+func (d *wavDecoder) SeekFrame(frame int64) error {
+	offset := frame * int64(d.frameSize())
+
+	if offset > d.dataSize {
+		offset = d.dataSize
+	}
+
+	if _, err := d.file.Seek(d.dataOffset+offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	d.data = io.LimitReader(bufio.NewReader(d.file), d.dataSize-offset)
+	d.reset(0)
+
+	return nil
+}
+
+func (d *wavDecoder) Close() error {
+	return d.file.Close()
+}
+
+func (d *wavDecoder) parseHeader(reader *bufio.Reader) error {
+	// Skip 'RIFF', size and 'WAVE'
+	if _, err := reader.Discard(12); err != nil {
+		return err
+	}
+
+	header := make([]byte, 8)
+	offset := int64(12)
+	formatFound := false
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return errors.New("wav: missing data chunk")
+		}
+
+		id := string(header[:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:]))
+		offset += 8
+
+		if id == "data" {
+			if !formatFound {
+				return errors.New("wav: data chunk before format chunk")
+			}
+
+			info, err := d.file.Stat()
+
+			if err != nil {
+				return err
+			}
+
+			// Size is invalid for some streamed files
+			if size == 0 || offset+size > info.Size() {
+				size = info.Size() - offset
+			}
+
+			d.dataOffset = offset
+			d.dataSize = size
+
+			return nil
+		}
+
+		if id == "fmt " {
+			if err := d.parseFormat(reader, size); err != nil {
+				return err
+			}
+
+			formatFound = true
+		} else if id == "LIST" && size <= maxWavInfoSize {
+			list := make([]byte, size)
+
+			if _, err := io.ReadFull(reader, list); err != nil {
+				return err
+			}
+
+			// Metadata after the samples isn't read
+			if tags := parseRiffInfo(list); len(tags) > 0 {
+				d.tags = tags
+			}
+		} else if _, err := reader.Discard(int(size)); err != nil {
+			return err
+		}
+
+		// Chunks are padded to an even size
+		if size%2 == 1 {
+			if _, err := reader.Discard(1); err != nil {
+				return err
+			}
+
+			size++
+		}
+
+		offset += size
+	}
+}
+
+func (d *wavDecoder) parseFormat(reader io.Reader, size int64) error {
+	if size < 16 {
+		return errors.New("wav: invalid format chunk")
+	}
+
+	format := make([]byte, size)
+
+	if _, err := io.ReadFull(reader, format); err != nil {
+		return err
+	}
+
+	tag := binary.LittleEndian.Uint16(format[0:])
+	d.channels = int(binary.LittleEndian.Uint16(format[2:]))
+	d.sampleRate = int(binary.LittleEndian.Uint32(format[4:]))
+	d.bitDepth = int(binary.LittleEndian.Uint16(format[14:]))
+
+	// Actual format is stored in the sub format GUID
+	if tag == wavFormatExtensible && size >= 26 {
+		tag = binary.LittleEndian.Uint16(format[24:])
+	}
+
+	switch {
+	case tag == wavFormatPCM && d.bitDepth%8 == 0 && d.bitDepth >= 8 && d.bitDepth <= 32:
+	case tag == wavFormatFloat && (d.bitDepth == 32 || d.bitDepth == 64):
+		d.float = true
+	default:
+		return fmt.Errorf("wav: unsupported format %#x with %d bits", tag, d.bitDepth)
+	}
+
+	if d.channels < 1 || d.sampleRate < 1 {
+		return errors.New("wav: invalid format chunk")
+	}
+
+	return nil
+}
+
+func (d *wavDecoder) frameSize() int {
+	return d.channels * d.bitDepth / 8
+}
+
+func (d *wavDecoder) decodeFrames() error {
+	n, err := io.ReadFull(d.data, d.frames)
+
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	frameSize := d.frameSize()
+	frameCount := n / frameSize
+
+	if frameCount == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+
+		return err
+	}
+
+	sampleSize := d.bitDepth / 8
+
+	for i := 0; i < frameCount; i++ {
+		frame := d.frames[i*frameSize:]
+
+		for c := 0; c < d.channels; c++ {
+			d.appendSample(d.decodeSample(frame[c*sampleSize:]))
+		}
+	}
+
+	return nil
+}
+
+func (d *wavDecoder) decodeSample(data []byte) int16 {
+	if d.float {
+		if d.bitDepth == 64 {
+			bits := binary.LittleEndian.Uint64(data)
+
+			return floatToSample(math.Float64frombits(bits))
+		}
+
+		bits := binary.LittleEndian.Uint32(data)
+
+		return floatToSample(float64(math.Float32frombits(bits)))
+	}
+
+	// 8 bit samples are unsigned
+	if d.bitDepth == 8 {
+		return int16(int(data[0])-128) << 8
+	}
+
+	// Use the most significant 16 bits
+	offset := d.bitDepth/8 - 2
+
+	return int16(uint16(data[offset]) | uint16(data[offset+1])<<8)
+}
@@ -24,7 +24,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/medusalix/multispeaker/audio"
 	"github.com/medusalix/multispeaker/network"
 )
 
@@ -33,11 +35,23 @@ var Prompt string
 
 var mutex sync.Mutex
 var commands = map[string]func(server *network.Server, args []string){
-	"help": help,
-	"list": listUsers,
-	"play": playMusic,
-	"stop": stopMusic,
-	"vol":  changeVolume,
+	"help":    help,
+	"list":    listUsers,
+	"status":  printStatus,
+	"play":    playMusic,
+	"stop":    stopMusic,
+	"pause":   pauseMusic,
+	"resume":  resumeMusic,
+	"seek":    seekMusic,
+	"queue":   handleQueue,
+	"next":    nextTrack,
+	"prev":    previousTrack,
+	"shuffle": shuffleQueue,
+	"repeat":  setRepeat,
+	"vol":     changeVolume,
+	"mute":    muteUser,
+	"unmute":  unmuteUser,
+	"map":     mapChannels,
 }
 
 // Writeln writes to standard output with a newline
@@ -100,10 +114,28 @@ func help(server *network.Server, args []string) {
 	Writeln(
 		"Commands:\n\n" +
 			"list: Prints a list of all currently connected users.\n" +
-			"play <file>: Starts playback of a specified MP3 file.\n" +
+			"status: Prints the currently played track and its position.\n" +
+			"play [file|dir]: Replaces the queue with an audio file (MP3, WAV, FLAC or Ogg Vorbis)\n" +
+			"or all audio files of a directory and starts playback. Plays the queue if nothing is supplied.\n" +
 			"stop: Stops the music playback.\n" +
-			"vol <user|all> <volume>: Sets the system volume of a users's computer.\n" +
+			"pause: Pauses the music playback.\n" +
+			"resume: Resumes the paused music playback.\n" +
+			"seek <[+|-]mm:ss>: Jumps to a position in the music.\n" +
+			"A leading + or - jumps relative to the current position.\n" +
+			"queue: Prints the tracks of the queue.\n" +
+			"queue add <file|dir>: Appends an audio file or all audio files of a directory to the queue.\n" +
+			"queue remove <index>: Removes a track from the queue.\n" +
+			"queue move <from> <to>: Moves a track to another position in the queue.\n" +
+			"queue clear: Removes all tracks except for the playing one from the queue.\n" +
+			"next: Skips to the next track of the queue.\n" +
+			"prev: Goes back to the previous track of the queue.\n" +
+			"shuffle: Randomizes the order of the upcoming tracks.\n" +
+			"repeat [off|one|all]: Sets what happens at the end of a track.\n" +
+			"vol <user|all> <volume>: Sets the volume of a user's speakers.\n" +
 			"If all is supplied, the volume of all connected users is changed.\n" +
+			"mute <user|all>: Mutes a user's speakers without changing the volume.\n" +
+			"unmute <user|all>: Unmutes a user's speakers.\n" +
+			"map <user|all> <stereo|left|right|mono>: Sets which channels a user's speakers play.\n" +
 			"exit: Exits the program.",
 	)
 }
@@ -114,14 +146,44 @@ func listUsers(server *network.Server, args []string) {
 	}
 }
 
-func playMusic(server *network.Server, args []string) {
-	if len(args) < 1 {
-		Writeln("Args: <file>")
+func printStatus(server *network.Server, args []string) {
+	status := server.Status()
+
+	if !status.Playing {
+		Writeln("Music is currently not playing")
 
 		return
 	}
 
-	if err := server.PlayMusic(args[0]); err != nil {
+	state := "Playing"
+
+	if status.Paused {
+		state = "Paused"
+	}
+
+	Writef("%s '%s'", state, status.Metadata)
+	Writef("File: %s", status.Track)
+
+	// Unknown lengths are zero
+	if status.Length > 0 {
+		Writef("Position: %s / %s", formatPosition(status.Position), formatPosition(status.Length))
+	} else {
+		Writef("Position: %s", formatPosition(status.Position))
+	}
+
+	Writef("Repeat: %s", status.Repeat)
+}
+
+func playMusic(server *network.Server, args []string) {
+	var err error
+
+	if len(args) < 1 {
+		err = server.PlayQueue()
+	} else {
+		err = server.PlayMusic(args[0])
+	}
+
+	if err != nil {
 		Writeln("Error starting music playback:", err)
 	} else {
 		Writeln("Started music playback")
@@ -136,6 +198,201 @@ func stopMusic(server *network.Server, args []string) {
 	}
 }
 
+func pauseMusic(server *network.Server, args []string) {
+	if err := server.Pause(); err != nil {
+		Writeln("Error pausing music playback:", err)
+	} else {
+		Writeln("Paused music playback")
+	}
+}
+
+func resumeMusic(server *network.Server, args []string) {
+	if err := server.Resume(); err != nil {
+		Writeln("Error resuming music playback:", err)
+	} else {
+		Writeln("Resumed music playback")
+	}
+}
+
+func seekMusic(server *network.Server, args []string) {
+	if len(args) < 1 {
+		Writeln("Args: <[+|-]mm:ss>")
+
+		return
+	}
+
+	arg := args[0]
+	relative := strings.HasPrefix(arg, "+") || strings.HasPrefix(arg, "-")
+	offset, err := parsePosition(strings.TrimLeft(arg, "+-"))
+
+	if err != nil {
+		Writeln("Invalid position:", err)
+
+		return
+	}
+
+	position := offset
+
+	if relative {
+		current, err := server.Position()
+
+		if err != nil {
+			Writeln("Error seeking music:", err)
+
+			return
+		}
+
+		if strings.HasPrefix(arg, "-") {
+			position = current - offset
+		} else {
+			position = current + offset
+		}
+	}
+
+	if position < 0 {
+		position = 0
+	}
+
+	// Unknown lengths are zero
+	if length, err := server.Length(); err == nil && length > 0 && position > length {
+		position = length
+	}
+
+	if err := server.Seek(position); err != nil {
+		Writeln("Error seeking music:", err)
+	} else {
+		Writef("Jumped to '%s'", formatPosition(position))
+	}
+}
+
+func handleQueue(server *network.Server, args []string) {
+	if len(args) < 1 {
+		listQueue(server)
+
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "add":
+		if len(args) < 2 {
+			Writeln("Args: add <file|dir>")
+
+			return
+		}
+
+		if count, err := server.Enqueue(args[1]); err != nil {
+			Writeln("Error adding to queue:", err)
+		} else {
+			Writef("Added %d track(s) to the queue", count)
+		}
+	case "remove":
+		if len(args) < 2 {
+			Writeln("Args: remove <index>")
+
+			return
+		}
+
+		index, err := parseIndex(args[1])
+
+		if err != nil {
+			Writeln("Invalid index:", err)
+		} else if err := server.Dequeue(index); err != nil {
+			Writeln("Error removing track:", err)
+		} else {
+			Writeln("Removed track from the queue")
+		}
+	case "move":
+		if len(args) < 3 {
+			Writeln("Args: move <from> <to>")
+
+			return
+		}
+
+		from, err := parseIndex(args[1])
+
+		if err != nil {
+			Writeln("Invalid index:", err)
+
+			return
+		}
+
+		to, err := parseIndex(args[2])
+
+		if err != nil {
+			Writeln("Invalid index:", err)
+		} else if err := server.MoveTrack(from, to); err != nil {
+			Writeln("Error moving track:", err)
+		} else {
+			Writeln("Moved track in the queue")
+		}
+	case "clear":
+		server.ClearQueue()
+		Writeln("Cleared the queue")
+	default:
+		Writeln("Args: [add|remove|move|clear]")
+	}
+}
+
+func listQueue(server *network.Server) {
+	tracks, current := server.Queue()
+
+	if len(tracks) == 0 {
+		Writeln("Queue is empty")
+
+		return
+	}
+
+	for i, track := range tracks {
+		marker := " "
+
+		if i == current {
+			marker = ">"
+		}
+
+		Writef("%s %d. %s", marker, i+1, track)
+	}
+
+	Writef("Repeat: %s", server.Repeat())
+}
+
+func nextTrack(server *network.Server, args []string) {
+	if err := server.Next(); err != nil {
+		Writeln("Error skipping track:", err)
+	} else {
+		Writeln("Skipped to the next track")
+	}
+}
+
+func previousTrack(server *network.Server, args []string) {
+	if err := server.Previous(); err != nil {
+		Writeln("Error going back:", err)
+	} else {
+		Writeln("Went back to the previous track")
+	}
+}
+
+func shuffleQueue(server *network.Server, args []string) {
+	server.Shuffle()
+	Writeln("Shuffled the upcoming tracks")
+}
+
+func setRepeat(server *network.Server, args []string) {
+	if len(args) < 1 {
+		Writef("Repeat: %s", server.Repeat())
+
+		return
+	}
+
+	mode, err := network.ParseRepeatMode(args[0])
+
+	if err != nil {
+		Writeln("Invalid repeat mode:", err)
+	} else {
+		server.SetRepeat(mode)
+		Writef("Set repeat mode to '%s'", mode)
+	}
+}
+
 func changeVolume(server *network.Server, args []string) {
 	if len(args) < 2 {
 		Writeln("Args: <user|all> <volume>")
@@ -159,6 +416,95 @@ func changeVolume(server *network.Server, args []string) {
 	}
 }
 
+func muteUser(server *network.Server, args []string) {
+	setMuted(server, args, true)
+}
+
+func unmuteUser(server *network.Server, args []string) {
+	setMuted(server, args, false)
+}
+
+func setMuted(server *network.Server, args []string, muted bool) {
+	if len(args) < 1 {
+		Writeln("Args: <user|all>")
+
+		return
+	}
+
+	user := args[0]
+
+	if err := server.SetMuted(user, muted); err != nil {
+		Writeln("Error muting:", err)
+	} else if muted {
+		Writef("Muted user '%s'", user)
+	} else {
+		Writef("Unmuted user '%s'", user)
+	}
+}
+
+func mapChannels(server *network.Server, args []string) {
+	if len(args) < 2 {
+		Writeln("Args: <user|all> <stereo|left|right|mono>")
+
+		return
+	}
+
+	user := args[0]
+	mapping, err := audio.ParseChannelMap(args[1])
+
+	if err != nil {
+		Writeln("Invalid channel map:", err)
+	} else if err := server.SetChannelMap(user, mapping); err != nil {
+		Writeln("Error setting channel map:", err)
+	} else {
+		Writef("Set channel map of user '%s' to '%s'", user, mapping)
+	}
+}
+
+// parseIndex parses a track number starting at 1
+func parseIndex(input string) (int, error) {
+	index, err := strconv.Atoi(input)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return index - 1, nil
+}
+
+// parsePosition parses a position in the form mm:ss or ss
+func parsePosition(input string) (time.Duration, error) {
+	parts := strings.Split(input, ":")
+
+	if len(parts) > 2 {
+		return 0, fmt.Errorf("expected mm:ss, got '%s'", input)
+	}
+
+	seconds, err := strconv.Atoi(parts[len(parts)-1])
+
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid seconds '%s'", parts[len(parts)-1])
+	}
+
+	if len(parts) == 2 {
+		minutes, err := strconv.Atoi(parts[0])
+
+		if err != nil || minutes < 0 {
+			return 0, fmt.Errorf("invalid minutes '%s'", parts[0])
+		}
+
+		seconds += minutes * 60
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func formatPosition(position time.Duration) string {
+	seconds := int(position / time.Second)
+
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
 func parseInput(input string) []string {
 	input = strings.TrimSuffix(input, "\n")
 	input = strings.TrimSuffix(input, "\r")
@@ -5,5 +5,8 @@ require (
 	github.com/hajimehoshi/go-mp3 v0.1.1
 	github.com/hajimehoshi/oto v0.3.1
 	github.com/itchyny/volume-go v0.0.1-0.20181225084746-cfcacecfa11c
+	github.com/jfreymuth/oggvorbis v1.0.1
+	github.com/jfreymuth/vorbis v1.0.0 // indirect
+	github.com/mewkiz/flac v1.0.5
 	github.com/moutend/go-wca v0.1.1
 )
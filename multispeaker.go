@@ -17,10 +17,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/medusalix/multispeaker/api"
+	"github.com/medusalix/multispeaker/audio"
 	"github.com/medusalix/multispeaker/cli"
 	"github.com/medusalix/multispeaker/log"
 	"github.com/medusalix/multispeaker/network"
@@ -31,6 +37,12 @@ const (
 	defaultStreamPort  = 12346
 )
 
+// Time for the server to close all connections when exiting
+const shutdownTimeout = time.Second * 5
+
+// Environment variable used if no pre-shared key is specified
+const pskEnvVar = "MULTISPEAKER_PSK"
+
 // Can be specified using linker flag "-X"
 var defaultClientAddr string
 
@@ -40,7 +52,32 @@ func main() {
 	controlPort := flag.Int("control-port", defaultControlPort, "Port for the control connection")
 	streamPort := flag.Int("stream-port", defaultStreamPort, "Port for the stream connection")
 	server := flag.Bool("server", false, "Start as server")
-	client := flag.String("client", defaultClientAddr, "Address to connect the client to")
+	client := flag.String("client", defaultClientAddr, "Address to connect the client to (discovered if empty)")
+	serverName := flag.String("server-name", "", "Name of the discovered server to connect to")
+	name := flag.String("name", "", "Name the server is discovered with (defaults to the hostname)")
+	discovery := flag.Bool("discovery", true, "Let clients discover the server")
+	clientID := flag.String("id", "", "Unique ID of the client (generated if empty)")
+	multicastAddr := flag.String("multicast", "", "Multicast group for streaming (e.g. '239.255.77.77:12347')")
+	codecName := flag.String("codec", "pcm", "Codec for streaming ('pcm' or 'lossless')")
+	useTLS := flag.Bool("tls", false, "Connect to the server using TLS (implied by the other TLS flags)")
+	tlsCert := flag.String("tls-cert", "", "Certificate file (PEM) for TLS")
+	tlsKey := flag.String("tls-key", "", "Private key file (PEM) of the certificate")
+	tlsCA := flag.String("tls-ca", "", "CA file (PEM) for verifying the server or requiring client certificates")
+	psk := flag.String("psk", "", "Pre-shared key for authentication (or set "+pskEnvVar+")")
+	lead := flag.Duration("lead", network.DefaultLeadWindow, "Time the samples are streamed ahead until the clients report their buffer targets")
+	bufferTarget := flag.Duration("buffer", network.DefaultBufferTarget, "Duration of the samples the client aims to buffer")
+	sampleRate := flag.Int("rate", 0, "Sample rate the server streams or the client plays at (0 keeps the rate of each track)")
+	timeout := flag.Duration("timeout", network.DefaultHeartbeatTimeout, "Time after which an unresponsive peer is disconnected")
+	reconnectDelay := flag.Duration("reconnect-delay", network.DefaultBackoff.InitialDelay, "Delay before the client reconnects")
+	reconnectMultiplier := flag.Float64("reconnect-multiplier", network.DefaultBackoff.Multiplier, "Factor the reconnect delay grows by after each failed attempt")
+	reconnectMaxDelay := flag.Duration("reconnect-max-delay", network.DefaultBackoff.MaxDelay, "Longest delay between two reconnect attempts")
+	reconnectJitter := flag.Float64("reconnect-jitter", network.DefaultBackoff.Jitter, "Fraction of the reconnect delay that is randomized (0 to 1)")
+	reconnectRetries := flag.Int("reconnect-retries", 0, "Number of failed reconnect attempts after which the client exits (0 for unlimited)")
+	volumeMode := flag.String("volume", "software", "How the client changes its volume ('software' or 'system')")
+	gainMode := flag.String("replaygain", "off", "How the loudness of the tracks is normalized ('off', 'track' or 'album')")
+	slowClient := flag.String("slow-client", "drop", "What happens when a client can't keep up ('drop', 'disconnect' or 'lag')")
+	httpAddr := flag.String("http", "", "Address for the HTTP control API (e.g. ':8080')")
+	headless := flag.Bool("headless", false, "Run the server without reading commands from the terminal")
 
 	flag.Parse()
 
@@ -56,41 +93,231 @@ func main() {
 	cli.Writeln("multispeaker v1.0.3 ©Severin v. W.")
 	cli.Writeln()
 
+	if *psk == "" {
+		*psk = os.Getenv(pskEnvVar)
+	}
+
+	security := &network.SecurityConfig{
+		CertFile: *tlsCert,
+		KeyFile:  *tlsKey,
+		CAFile:   *tlsCA,
+		PSK:      *psk,
+	}
+	secure := *tlsCert != "" || *tlsCA != "" || *psk != ""
+
 	controlAddr := &net.TCPAddr{Port: *controlPort}
 	streamAddr := &net.TCPAddr{Port: *streamPort}
 
 	if *server {
-		cli.Prompt = "> "
+		if !*headless {
+			cli.Prompt = "> "
+		}
 
 		server := network.NewServer(controlAddr, streamAddr)
 
+		if *multicastAddr != "" {
+			group, err := net.ResolveUDPAddr("udp", *multicastAddr)
+
+			if err != nil {
+				cli.Writeln("Error resolving multicast group:", err)
+
+				return
+			}
+
+			server.EnableMulticast(group)
+		}
+
+		codec, err := network.ParseCodec(*codecName)
+
+		if err != nil {
+			cli.Writeln("Error selecting codec:", err)
+
+			return
+		}
+
+		server.SetCodec(codec)
+
+		policy, err := network.ParseSlowClientPolicy(*slowClient)
+
+		if err != nil {
+			cli.Writeln("Error selecting slow client policy:", err)
+
+			return
+		}
+
+		server.SetSlowClientPolicy(policy)
+
+		if err := server.SetLeadWindow(*lead); err != nil {
+			cli.Writeln("Error setting lead window:", err)
+
+			return
+		}
+
+		if err := server.SetSampleRate(*sampleRate); err != nil {
+			cli.Writeln("Error setting sample rate:", err)
+
+			return
+		}
+
+		if err := server.SetHeartbeatTimeout(*timeout); err != nil {
+			cli.Writeln("Error setting timeout:", err)
+
+			return
+		}
+
+		mode, err := audio.ParseGainMode(*gainMode)
+
+		if err != nil {
+			cli.Writeln("Error selecting gain mode:", err)
+
+			return
+		}
+
+		if err := server.SetGainMode(mode); err != nil {
+			cli.Writeln("Error enabling loudness normalization:", err)
+
+			return
+		}
+
+		if secure {
+			if err := server.EnableSecurity(security); err != nil {
+				cli.Writeln("Error enabling TLS:", err)
+
+				return
+			}
+		}
+
+		if *discovery {
+			if *name == "" {
+				*name, _ = os.Hostname()
+			}
+
+			if err := server.EnableDiscovery(*name); err != nil {
+				cli.Writeln("Error enabling discovery:", err)
+
+				return
+			}
+		}
+
 		if err := server.Start(); err != nil {
 			cli.Writeln("Error starting server:", err)
 
 			return
 		}
 
-		cli.HandleCommands(server)
-	} else if *client != "" {
-		addr, err := net.ResolveIPAddr("ip", *client)
+		if *httpAddr != "" {
+			if err := api.NewServer(*httpAddr, server).Start(); err != nil {
+				cli.Writeln("Error starting HTTP API:", err)
+
+				return
+			}
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+		if *headless {
+			// Only controlled over the network
+			<-signals
+		} else {
+			go func() {
+				<-signals
+				shutdownServer(server)
+				os.Exit(0)
+			}()
+
+			cli.HandleCommands(server)
+		}
+
+		shutdownServer(server)
+	} else {
+		discover := *client == ""
+
+		if !discover {
+			addr, err := net.ResolveIPAddr("ip", *client)
+
+			if err != nil {
+				cli.Writeln("Error resolving address:", err)
+
+				return
+			}
+
+			controlAddr.IP = addr.IP
+			streamAddr.IP = addr.IP
+			security.ServerName = *client
+		}
+
+		client := network.NewClient(controlAddr, streamAddr, *clientID)
+
+		if err := client.SetBufferTarget(*bufferTarget); err != nil {
+			cli.Writeln("Error setting buffer target:", err)
+
+			return
+		}
+
+		if err := client.SetSampleRate(*sampleRate); err != nil {
+			cli.Writeln("Error setting sample rate:", err)
+
+			return
+		}
+
+		if err := client.SetHeartbeatTimeout(*timeout); err != nil {
+			cli.Writeln("Error setting timeout:", err)
+
+			return
+		}
+
+		mode, err := network.ParseVolumeMode(*volumeMode)
 
 		if err != nil {
-			cli.Writeln("Error resolving address:", err)
+			cli.Writeln("Error selecting volume mode:", err)
 
 			return
 		}
 
-		controlAddr.IP = addr.IP
-		streamAddr.IP = addr.IP
+		client.SetVolumeMode(mode)
 
-		client := network.NewClient(controlAddr, streamAddr)
+		err = client.SetBackoff(&network.BackoffConfig{
+			InitialDelay: *reconnectDelay,
+			Multiplier:   *reconnectMultiplier,
+			MaxDelay:     *reconnectMaxDelay,
+			Jitter:       *reconnectJitter,
+			MaxRetries:   *reconnectRetries,
+		})
 
-		if err := client.Start(); err != nil {
-			cli.Writeln("Error starting client:", err)
+		if err != nil {
+			cli.Writeln("Error setting reconnect backoff:", err)
 
 			return
 		}
-	} else {
-		flag.PrintDefaults()
+
+		if discover {
+			client.EnableDiscovery(*serverName)
+		}
+
+		if secure || *useTLS {
+			if err := client.EnableSecurity(security); err != nil {
+				cli.Writeln("Error enabling TLS:", err)
+
+				return
+			}
+		}
+
+		if err := client.Start(); err != nil {
+			cli.Writeln("Error running client:", err)
+
+			// Lets service managers notice the failure
+			os.Exit(1)
+		}
+	}
+}
+
+// shutdownServer notifies the clients before exiting
+func shutdownServer(server *network.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		cli.Writeln("Error shutting down server:", err)
 	}
 }
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// BackoffConfig specifies how the client retries connecting to the server
+type BackoffConfig struct {
+	// Delay before the first retry
+	InitialDelay time.Duration
+	// Factor the delay grows by after each failed attempt
+	Multiplier float64
+	// Longest delay between two attempts
+	MaxDelay time.Duration
+	// Fraction of the delay that is randomized (0 to 1),
+	// keeps clients from reconnecting at the same time
+	Jitter float64
+	// Number of retries after which the client gives up (0 for unlimited)
+	MaxRetries int
+}
+
+// DefaultBackoff is used if no other configuration is specified
+var DefaultBackoff = BackoffConfig{
+	InitialDelay: time.Second,
+	Multiplier:   2,
+	MaxDelay:     time.Second * 30,
+	Jitter:       0.25,
+}
+
+// backoff calculates the delays between failed connection attempts
+type backoff struct {
+	config  BackoffConfig
+	retries int
+	delay   time.Duration
+}
+
+func checkBackoff(config *BackoffConfig) error {
+	if config.InitialDelay <= 0 {
+		return errors.New("initial delay must be positive")
+	}
+
+	if config.MaxDelay < config.InitialDelay {
+		return errors.New("maximum delay must not be shorter than the initial delay")
+	}
+
+	if config.Multiplier < 1 {
+		return errors.New("multiplier must be at least 1")
+	}
+
+	if config.Jitter < 0 || config.Jitter > 1 {
+		return errors.New("jitter must be between 0 and 1")
+	}
+
+	if config.MaxRetries < 0 {
+		return errors.New("maximum retry count must not be negative")
+	}
+
+	return nil
+}
+
+func newBackoff(config BackoffConfig) *backoff {
+	b := &backoff{config: config}
+	b.reset()
+
+	return b
+}
+
+// reset starts again with the initial delay after connecting successfully
+func (b *backoff) reset() {
+	b.retries = 0
+	b.delay = b.config.InitialDelay
+}
+
+// suggest uses the given delay for the next retry
+func (b *backoff) suggest(delay time.Duration) {
+	b.delay = delay
+
+	if b.delay > b.config.MaxDelay {
+		b.delay = b.config.MaxDelay
+	}
+}
+
+// next returns the delay until the next retry, ok is false if the client should give up
+func (b *backoff) next() (time.Duration, bool) {
+	if b.config.MaxRetries > 0 && b.retries >= b.config.MaxRetries {
+		return 0, false
+	}
+
+	b.retries++
+
+	// Randomize by up to the jitter in both directions
+	delay := float64(b.delay) * (1 + b.config.Jitter*(2*rand.Float64()-1))
+
+	b.delay = time.Duration(float64(b.delay) * b.config.Multiplier)
+
+	if b.delay > b.config.MaxDelay {
+		b.delay = b.config.MaxDelay
+	}
+
+	return time.Duration(delay), true
+}
@@ -17,68 +17,326 @@
 package network
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"os/user"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
-	volume "github.com/itchyny/volume-go"
 	"github.com/medusalix/multispeaker/audio"
 	"github.com/medusalix/multispeaker/log"
 )
 
-const reconnectDelay = time.Second * 5
+const (
+	// File in the user's config directory storing the client ID
+	clientIDFile = "multispeaker/client-id"
+	// Maximum length of the client ID
+	maxClientIDLength = 255
+)
+
+const (
+	// Interval between the initial clock synchronizations
+	clockBurstInterval = time.Millisecond * 100
+	// Interval between regular clock synchronizations
+	clockSyncInterval = time.Second * 2
+	// Number of received packets waiting for playback, covers the longest lead window
+	chunkQueueSize = 4096
+	// Delay after which late samples are skipped
+	maxChunkLateness = time.Millisecond * 5
+	// Number of past epochs whose chunks are still accepted
+	epochHistory = 4
+)
+
+// goodbyeError is returned when the server is shutting down
+type goodbyeError struct {
+	reason         string
+	reconnectDelay time.Duration
+}
+
+func (e *goodbyeError) Error() string {
+	return "server said goodbye: " + e.reason
+}
 
 // Client is used to connect to the server and stream music
 type Client struct {
-	controlAddr *net.TCPAddr
-	streamAddr  *net.TCPAddr
-	control     *protocol
-	stream      *protocol
-	player      *audio.Player
+	controlAddr   *net.TCPAddr
+	streamAddr    *net.TCPAddr
+	id            string
+	token         []byte
+	multicastAddr string
+	security      *security
+	discover      bool
+	serverName    string
+	receiver      *multicastReceiver
+	control       *protocol
+	stream        *protocol
+	player        *audio.Player
+	outputRate    int
+	volumeMode    VolumeMode
+	buffer        *jitterBuffer
+	bufferTarget  time.Duration
+	timeout       time.Duration
+	roundTrip     time.Duration
+	backoff       BackoffConfig
+	// Delay suggested by the server when shutting down
+	goodbyeDelay time.Duration
+	clock        *clock
+	mutex        sync.Mutex
+	epoch        int
+	epochStarts  map[int]int64
+	// Chunks of earlier epochs were flushed
+	flushEpoch int
+	// Samples held back by the player are discarded before the flushed epoch
+	flushPending bool
+	interrupt    chan bool
 }
 
-// NewClient constructs a new client
-func NewClient(controlAddr *net.TCPAddr, streamAddr *net.TCPAddr) *Client {
+// NewClient constructs a new client, a persistent ID is generated if none is given
+func NewClient(controlAddr *net.TCPAddr, streamAddr *net.TCPAddr, id string) *Client {
 	return &Client{
-		controlAddr: controlAddr,
-		streamAddr:  streamAddr,
-		player:      audio.NewPlayer(),
+		controlAddr:  controlAddr,
+		streamAddr:   streamAddr,
+		id:           id,
+		player:       audio.NewPlayer(),
+		bufferTarget: DefaultBufferTarget,
+		timeout:      DefaultHeartbeatTimeout,
+		backoff:      DefaultBackoff,
+		interrupt:    make(chan bool, 1),
+		epochStarts:  make(map[int]int64),
+	}
+}
+
+// SetBufferTarget specifies the duration of the samples the client aims to buffer,
+// the server streams the samples at least this far ahead
+func (c *Client) SetBufferTarget(target time.Duration) error {
+	if target < minBufferTarget || target > maxLeadWindow {
+		return fmt.Errorf("buffer target must be between %s and %s", minBufferTarget, maxLeadWindow)
 	}
+
+	c.bufferTarget = target
+
+	return nil
+}
+
+// SetSampleRate resamples the stream to the given rate (0 plays each track at its own rate),
+// keeps the player from being recreated when the sample rate changes
+func (c *Client) SetSampleRate(sampleRate int) error {
+	if err := checkSampleRate(sampleRate); err != nil {
+		return err
+	}
+
+	c.outputRate = sampleRate
+	c.player.SetOutputRate(sampleRate)
+
+	return nil
+}
+
+// playableSampleRates lists the sample rates the player is able to play,
+// any rate is resampled if it plays at a fixed rate
+func (c *Client) playableSampleRates() []int {
+	if c.outputRate > 0 {
+		return nil
+	}
+
+	return deviceSampleRates
+}
+
+// SetHeartbeatTimeout specifies after which time a silent server is considered dead
+func (c *Client) SetHeartbeatTimeout(timeout time.Duration) error {
+	if err := checkHeartbeatTimeout(timeout); err != nil {
+		return err
+	}
+
+	c.timeout = timeout
+
+	return nil
+}
+
+// SetVolumeMode specifies if the player or the operating system changes the volume
+func (c *Client) SetVolumeMode(mode VolumeMode) {
+	c.volumeMode = mode
+}
+
+// SetBackoff specifies the delays between connection attempts
+func (c *Client) SetBackoff(config *BackoffConfig) error {
+	if err := checkBackoff(config); err != nil {
+		return err
+	}
+
+	c.backoff = *config
+
+	return nil
+}
+
+// EnableSecurity connects to the server using TLS,
+// needs to be called before starting the client
+func (c *Client) EnableSecurity(config *SecurityConfig) error {
+	var err error
+	c.security, err = newClientSecurity(config)
+
+	return err
+}
+
+// EnableDiscovery searches for the server before connecting,
+// an empty name accepts the only server on the network
+func (c *Client) EnableDiscovery(serverName string) {
+	c.discover = true
+	c.serverName = serverName
 }
 
-// Start starts the client
+// Start starts the client, returns once the maximum number of retries is reached
 func (c *Client) Start() error {
+	if c.id == "" {
+		var err error
+		c.id, err = loadClientID()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.id) > maxClientIDLength {
+		return fmt.Errorf("client ID is longer than %d characters", maxClientIDLength)
+	}
+
+	log.Debugf("Using client ID '%s'", c.id)
+
+	retry := newBackoff(c.backoff)
+
 	for {
-		if err := c.run(); err != nil {
+		connected, err := c.run()
+
+		if err != nil {
 			log.Error("Connection error: ", err)
 		}
 
-		log.Info("Reconnecting")
-		time.Sleep(reconnectDelay)
+		// Lost connections are restored quickly
+		if connected {
+			retry.reset()
+		}
+
+		// Server knows when it will be back
+		if c.goodbyeDelay > 0 {
+			retry.suggest(c.goodbyeDelay)
+			c.goodbyeDelay = 0
+		}
+
+		delay, ok := retry.next()
+
+		if !ok {
+			return fmt.Errorf("giving up after %d retries", c.backoff.MaxRetries)
+		}
+
+		log.Infof("Reconnecting in %s", delay.Round(time.Millisecond))
+		time.Sleep(delay)
 	}
 }
 
-func (c *Client) run() error {
+// run connects to the server until the connection is lost,
+// returns whether the client was accepted
+func (c *Client) run() (bool, error) {
+	// Server's address might have changed since the last connection
+	if c.discover {
+		if err := c.discoverServer(); err != nil {
+			return false, err
+		}
+	}
+
 	if err := c.connectControl(); err != nil {
-		return err
+		return false, err
 	}
 
+	defer c.control.close()
+
 	log.Info("Connected to server")
 
+	// Server restores the channel map after accepting the client
+	c.player.SetChannelMap(audio.MapStereo)
+
+	if err := c.handshake(); err != nil {
+		return false, err
+	}
+
 	if err := c.announce(); err != nil {
+		return false, err
+	}
+
+	c.clock = &clock{}
+	go c.synchronizeClock(c.control)
+
+	go c.reportBuffer(c.control)
+	go sendPings(c.control)
+
+	err := c.listen()
+
+	c.closeReceiver()
+	c.closeStream()
+
+	if isTimeout(err) {
+		return true, fmt.Errorf("server didn't respond for %s (last round trip %s)", c.timeout, c.roundTrip)
+	}
+
+	if goodbye, ok := err.(*goodbyeError); ok {
+		log.Info("Disconnected by server: ", goodbye.reason)
+		c.goodbyeDelay = goodbye.reconnectDelay
+
+		return true, nil
+	}
+
+	return true, errors.New("connection lost")
+}
+
+// discoverServer finds the server's address on the local network
+func (c *Client) discoverServer() error {
+	log.Info("Searching for servers")
+
+	servers, err := discoverServers()
+
+	if err != nil {
 		return err
 	}
 
-	c.listen()
+	matching := make([]*discoveredServer, 0, len(servers))
+	names := make([]string, 0, len(servers))
+
+	for _, server := range servers {
+		if c.serverName == "" || server.name == c.serverName {
+			matching = append(matching, server)
+			names = append(names, "'"+server.name+"'")
+		}
+	}
+
+	if len(matching) == 0 {
+		if c.serverName != "" {
+			return fmt.Errorf("server '%s' not found", c.serverName)
+		}
+
+		return errors.New("no server found")
+	}
+
+	if len(matching) > 1 {
+		return fmt.Errorf("found multiple servers (%s), select one by name", strings.Join(names, ", "))
+	}
+
+	server := matching[0]
+	c.controlAddr = server.controlAddr
+	c.streamAddr = server.streamAddr
 
-	return errors.New("connection lost")
+	log.Infof("Found server '%s' at '%s'", server.name, server.controlAddr.IP)
+
+	return nil
 }
 
 func (c *Client) connectControl() error {
-	conn, err := net.DialTCP("tcp", nil, c.controlAddr)
+	conn, err := c.dial(c.controlAddr)
 
 	if err != nil {
 		return err
@@ -90,7 +348,7 @@ func (c *Client) connectControl() error {
 }
 
 func (c *Client) connectStream() error {
-	conn, err := net.DialTCP("tcp", nil, c.streamAddr)
+	conn, err := c.dial(c.streamAddr)
 
 	if err != nil {
 		return err
@@ -98,7 +356,64 @@ func (c *Client) connectStream() error {
 
 	c.stream = newProtocol(conn)
 
-	return nil
+	// Server assigns the stream to the control connection
+	return c.stream.send(&attachPacket{
+		token: c.token,
+	})
+}
+
+// dial connects to the server, performing the TLS handshake if enabled
+func (c *Client) dial(addr *net.TCPAddr) (net.Conn, error) {
+	conn, err := net.DialTCP("tcp", nil, addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.security == nil {
+		return conn, nil
+	}
+
+	secureConn, err := c.security.client(conn)
+
+	if err != nil {
+		conn.Close()
+
+		return nil, fmt.Errorf("authentication failed: %s", err)
+	}
+
+	return secureConn, nil
+}
+
+// handshake exchanges the hello packets with the server
+func (c *Client) handshake() error {
+	// Player is always able to change the volume
+	volumeControl := c.volumeMode == VolumeSoftware || canChangeSystemVolume()
+
+	if err := c.control.send(newHelloPacket(volumeControl, c.playableSampleRates())); err != nil {
+		return err
+	}
+
+	c.control.conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	packet, err := c.control.receive()
+	c.control.conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		return handshakeError(err, "server")
+	}
+
+	switch p := packet.(type) {
+	case *helloPacket:
+		if err := checkHello(p, "server"); err != nil {
+			return err
+		}
+
+		return nil
+	case *refusePacket:
+		return fmt.Errorf("refused by server: %s", p.reason)
+	}
+
+	return errors.New("server didn't answer the hello packet")
 }
 
 func (c *Client) announce() error {
@@ -109,10 +424,41 @@ func (c *Client) announce() error {
 	}
 
 	return c.control.send(&announcePacket{
+		id:   c.id,
 		name: username,
 	})
 }
 
+// loadClientID reads the client ID from the config directory or generates a new one
+func loadClientID() (string, error) {
+	configDir, err := os.UserConfigDir()
+
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(configDir, clientIDFile)
+	id, err := ioutil.ReadFile(path)
+
+	if err == nil && len(id) > 0 {
+		return strings.TrimSpace(string(id)), nil
+	}
+
+	randomID := make([]byte, 16)
+
+	if _, err := rand.Read(randomID); err != nil {
+		return "", err
+	}
+
+	newID := hex.EncodeToString(randomID)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	return newID, ioutil.WriteFile(path, []byte(newID), 0644)
+}
+
 func (c *Client) getUsername() (string, error) {
 	currentUser, err := user.Current()
 
@@ -133,41 +479,142 @@ func (c *Client) getUsername() (string, error) {
 
 func (c *Client) listen() error {
 	for {
-		packet, err := c.control.receive()
+		packet, err := receiveAlive(c.control, c.timeout)
 
 		if err != nil {
 			return err
 		}
 
 		switch p := packet.(type) {
+		case *acceptPacket:
+			c.token = p.token
+			c.multicastAddr = p.multicastAddr
 		case *preparePacket:
-			if err := c.preparePlayer(p.sampleRate); err != nil {
+			if err := c.preparePlayer(p.format, p.codec); err != nil {
 				log.Error("Error handling prepare packet: ", err)
 			}
 		case *volumePacket:
 			if err := c.changeVolume(p.volume); err != nil {
 				log.Error("Error handling volume packet: ", err)
 			}
+		case *mutePacket:
+			if err := c.mute(p.muted); err != nil {
+				log.Error("Error handling mute packet: ", err)
+			}
+		case *metadataPacket:
+			c.announceTrack(p)
+		case *channelMapPacket:
+			if err := c.mapChannels(p.mapping); err != nil {
+				log.Error("Error handling channel map packet: ", err)
+			}
+		case *repeatTrackPacket:
+			if c.receiver != nil {
+				c.receiver.repeatTrack(p.sequence, &p.track)
+			}
+		case *timeResponsePacket:
+			c.clock.update(p.clientTime, p.receiveTime, p.sendTime, now())
+		case *pausePacket:
+			c.pausePlayback(p.paused, p.epoch, p.timestamp)
+		case *flushPacket:
+			c.flushPlayback(p.epoch, p.timestamp)
+		case *pingPacket:
+			if err := answerPing(c.control, p); err != nil {
+				log.Error("Error answering ping: ", err)
+			}
+		case *pongPacket:
+			c.roundTrip = time.Duration(now() - p.sendTime)
+		case *goodbyePacket:
+			return &goodbyeError{
+				reason:         p.reason,
+				reconnectDelay: time.Duration(p.reconnectDelay),
+			}
 		}
 	}
 }
 
-func (c *Client) preparePlayer(sampleRate int) error {
+func (c *Client) synchronizeClock(control *protocol) {
+	for i := 0; ; i++ {
+		err := control.send(&timeRequestPacket{
+			clientTime: now(),
+		})
+
+		// Connection was closed
+		if err != nil {
+			return
+		}
+
+		if i == clockSampleCount {
+			log.Debug("Clock round trip: ", c.clock.roundTrip())
+		}
+
+		// Measure quickly after connecting
+		if i < clockSampleCount {
+			time.Sleep(clockBurstInterval)
+		} else {
+			time.Sleep(clockSyncInterval)
+		}
+	}
+}
+
+// reportBuffer sends the fill level of the jitter buffer to the server
+func (c *Client) reportBuffer(control *protocol) {
+	// Server streams the samples as far ahead as the target
+	if err := control.send(&bufferPacket{target: int64(c.bufferTarget)}); err != nil {
+		return
+	}
+
+	for {
+		time.Sleep(bufferReportInterval)
+
+		c.mutex.Lock()
+		buffer := c.buffer
+		c.mutex.Unlock()
+
+		// Music isn't playing
+		if buffer == nil {
+			continue
+		}
+
+		// Connection was closed
+		if err := control.send(buffer.report(c.clock)); err != nil {
+			return
+		}
+	}
+}
+
+func (c *Client) preparePlayer(format audio.Format, codec Codec) error {
 	if err := c.player.Close(); err != nil {
 		// Only log error, happens sometimes
 		log.Error("Error closing player: ", err)
 	}
 
-	if sampleRate == 0 {
+	c.closeReceiver()
+
+	c.mutex.Lock()
+	c.buffer = nil
+	c.mutex.Unlock()
+
+	if format.SampleRate == 0 {
 		return nil
 	}
 
-	log.Debug("Preparing player")
+	log.Debugf("Preparing player for %s stream", codec)
 
-	if err := c.player.Prepare(sampleRate); err != nil {
+	c.mutex.Lock()
+	c.epoch = 0
+	c.epochStarts = make(map[int]int64)
+	c.flushEpoch = 0
+	c.flushPending = false
+	c.mutex.Unlock()
+
+	if err := c.player.Prepare(format); err != nil {
 		return err
 	}
 
+	if c.multicastAddr != "" {
+		return c.joinMulticast(format, codec)
+	}
+
 	log.Debug("Connecting stream")
 
 	if err := c.connectStream(); err != nil {
@@ -176,22 +623,124 @@ func (c *Client) preparePlayer(sampleRate int) error {
 
 	log.Info("Starting music playback")
 
-	go c.streamMusic()
+	go c.streamMusic(c.stream, c.newBuffer(format), format, codec)
 
 	return nil
 }
 
-func (c *Client) streamMusic() {
+func (c *Client) joinMulticast(format audio.Format, codec Codec) error {
+	group, err := net.ResolveUDPAddr("udp", c.multicastAddr)
+
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Joining multicast group '%s'", group)
+
+	c.receiver, err = newMulticastReceiver(group, format, codec)
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("Starting music playback")
+
+	go c.receiveMulticast(c.receiver, c.newBuffer(format))
+
+	return nil
+}
+
+func (c *Client) receiveMulticast(receiver *multicastReceiver, buffer *jitterBuffer) {
+	go c.playChunks(buffer)
+	defer buffer.close()
+
+	receiver.receive(buffer)
+
+	log.Info("Left multicast group")
+}
+
+// closeStream closes the stream connection, a vanished server can't close it
+func (c *Client) closeStream() {
+	if c.stream == nil {
+		return
+	}
+
+	c.stream.close()
+	c.stream = nil
+}
+
+func (c *Client) closeReceiver() {
+	if c.receiver == nil {
+		return
+	}
+
+	if err := c.receiver.close(); err != nil {
+		log.Error("Error leaving multicast group: ", err)
+	}
+
+	c.receiver = nil
+}
+
+// newBuffer creates the jitter buffer for a new stream
+func (c *Client) newBuffer(format audio.Format) *jitterBuffer {
+	buffer := newJitterBuffer(c.bufferTarget, format)
+
+	c.mutex.Lock()
+	c.buffer = buffer
+	c.mutex.Unlock()
+
+	return buffer
+}
+
+func (c *Client) streamMusic(stream *protocol, buffer *jitterBuffer, format audio.Format, codec Codec) {
+	go c.playChunks(buffer)
+	defer buffer.close()
+
 	for {
-		samples, err := c.stream.receiveRaw()
+		packet, err := stream.receive()
 
 		if err != nil {
 			log.Info("Stream disconnected by server")
 
-			break
+			return
+		}
+
+		switch p := packet.(type) {
+		case *chunkPacket:
+			p.samples, err = decodeSamples(codec, p.samples, format.Channels)
+
+			if err != nil {
+				log.Debug("Unable to decode chunk: ", err)
+
+				continue
+			}
+
+			buffer.push(p)
+		case *trackPacket:
+			format = p.format
+			buffer.push(p)
+		}
+	}
+}
+
+func (c *Client) playChunks(buffer *jitterBuffer) {
+	for {
+		packet, ok := buffer.next(c.player.Latency())
+
+		if !ok {
+			return
 		}
 
-		_, err = c.player.Write(samples)
+		var err error
+
+		switch p := packet.(type) {
+		case nil:
+			err = c.playSilence(buffer)
+		case *chunkPacket:
+			err = c.playChunk(buffer, p)
+		case *trackPacket:
+			err = c.changeTrack(p.format, p.timestamp)
+		}
 
 		if err != nil {
 			log.Info("Music playback stopped")
@@ -199,13 +748,282 @@ func (c *Client) streamMusic() {
 			break
 		}
 	}
+
+	// Discard packets until the stream is closed
+	for range buffer.packets {
+	}
 }
 
-func (c *Client) changeVolume(vol int) error {
-	// Throws error when already unmuted
-	volume.Unmute()
+// changeTrack changes the format of the player when the previous track has ended
+func (c *Client) changeTrack(format audio.Format, timestamp int64) error {
+	previous := c.player.Format()
+
+	if format == previous {
+		return nil
+	}
+
+	// Player is only recreated if the sample rate changes and it doesn't resample
+	if c.outputRate == 0 && format.SampleRate != previous.SampleRate {
+		time.Sleep(time.Duration(c.clock.localTime(timestamp) - now()))
+	}
+
+	log.Debugf("Changing format to %d Hz, %d channels", format.SampleRate, format.Channels)
+
+	return c.player.ChangeFormat(format)
+}
+
+func (c *Client) playChunk(buffer *jitterBuffer, chunk *chunkPacket) error {
+	var delay time.Duration
+
+	for {
+		if !c.acceptChunk(chunk) {
+			return nil
+		}
+
+		// Samples need to be written ahead because of the player's buffer
+		writeTime := c.clock.localTime(chunk.timestamp) - int64(c.player.Latency())
+		delay = time.Duration(writeTime - now())
+
+		if delay <= 0 {
+			break
+		}
+
+		// Check chunk again after pausing
+		select {
+		case <-time.After(delay):
+		case <-c.interrupt:
+		}
+	}
+
+	samples := chunk.samples
+	format := c.player.Format()
+	frameSize := int64(format.FrameSize())
+
+	if -delay > maxChunkLateness {
+		buffer.late()
+
+		// Skip samples that should have been played already
+		frames := format.Frames(-delay)
+
+		if frames*frameSize >= int64(len(samples)) {
+			return nil
+		}
+
+		samples = samples[frames*frameSize:]
+	}
+
+	// Samples are written ahead, so they start at the announced timestamp
+	c.player.Resume()
+
+	if _, err := c.player.Write(samples); err != nil {
+		return err
+	}
+
+	frames := int64(len(chunk.samples)) / frameSize
+	buffer.wroteChunk(c.clock.localTime(chunk.timestamp) + int64(format.Duration(frames)))
+
+	return nil
+}
 
-	log.Infof("Setting volume to '%d'", vol)
+// playSilence keeps the player running while waiting for the next chunk
+func (c *Client) playSilence(buffer *jitterBuffer) error {
+	format := c.player.Format()
+	frames := format.Frames(silenceDuration)
 
-	return volume.SetVolume(vol)
+	if _, err := c.player.Write(make([]byte, frames*int64(format.FrameSize()))); err != nil {
+		return err
+	}
+
+	buffer.wroteSilence(format.Duration(frames))
+
+	return nil
+}
+
+func (c *Client) changeVolume(volume int) error {
+	if volume > audio.MaxVolume {
+		return fmt.Errorf("volume of %d is out of range", volume)
+	}
+
+	log.Infof("Setting volume to '%d'", volume)
+
+	if c.volumeMode == VolumeSystem {
+		return setSystemVolume(volume)
+	}
+
+	c.player.SetVolume(volume)
+
+	return nil
+}
+
+func (c *Client) mute(muted bool) error {
+	if muted {
+		log.Info("Muting speakers")
+	} else {
+		log.Info("Unmuting speakers")
+	}
+
+	if c.volumeMode == VolumeSystem {
+		return muteSystemVolume(muted)
+	}
+
+	c.player.SetMuted(muted)
+
+	return nil
+}
+
+func (c *Client) mapChannels(mapping audio.ChannelMap) error {
+	// Newer servers might send unknown maps
+	if err := audio.CheckChannelMap(mapping); err != nil {
+		return err
+	}
+
+	log.Infof("Set channel map to '%s'", mapping)
+	c.player.SetChannelMap(mapping)
+
+	return nil
+}
+
+// announceTrack logs the track the server has started playing
+func (c *Client) announceTrack(p *metadataPacket) {
+	metadata := audio.Metadata{
+		Title:    p.title,
+		Artist:   p.artist,
+		Album:    p.album,
+		Duration: time.Duration(p.duration),
+	}
+
+	log.Infof("Now playing '%s'", metadata)
+}
+
+func (c *Client) pausePlayback(paused bool, epoch int, timestamp int64) {
+	if !c.changeEpoch(epoch, timestamp) {
+		return
+	}
+
+	// Player is resumed by the first chunk of the new epoch
+	if !paused {
+		log.Info("Resuming music playback")
+
+		return
+	}
+
+	log.Info("Pausing music playback")
+
+	// Samples before the pause are still played
+	time.AfterFunc(time.Duration(c.clock.localTime(timestamp)-now()), func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		// Playback was resumed or restarted in the meantime
+		if c.epoch != epoch {
+			return
+		}
+
+		if err := c.player.Pause(); err != nil {
+			log.Error("Unable to pause player: ", err)
+		}
+	})
+}
+
+// flushPlayback discards the buffered samples, the new epoch starts at the given time
+func (c *Client) flushPlayback(epoch int, timestamp int64) {
+	// Chunks of the new epoch might have arrived before the flush
+	changed := c.changeEpoch(epoch, timestamp)
+
+	c.mutex.Lock()
+
+	if epoch <= c.flushEpoch {
+		c.mutex.Unlock()
+
+		return
+	}
+
+	c.flushEpoch = epoch
+	c.flushPending = changed
+	buffer := c.buffer
+
+	c.mutex.Unlock()
+
+	if buffer != nil {
+		buffer.flush(timestamp)
+	}
+
+	log.Debug("Flushing buffered samples")
+}
+
+// changeEpoch starts a new epoch and interrupts the waiting chunk
+func (c *Client) changeEpoch(epoch int, timestamp int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Chunks of the new epoch already arrived
+	if epoch <= c.epoch {
+		return false
+	}
+
+	c.startEpoch(epoch, timestamp)
+
+	select {
+	case c.interrupt <- true:
+	default:
+	}
+
+	return true
+}
+
+// acceptChunk removes samples of outdated epochs from a chunk
+func (c *Client) acceptChunk(chunk *chunkPacket) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Playback was resumed before receiving the packet
+	if chunk.epoch > c.epoch {
+		c.startEpoch(chunk.epoch, chunk.timestamp)
+	}
+
+	if chunk.epoch < c.flushEpoch {
+		return false
+	}
+
+	// Called by the playback, the player isn't written to concurrently
+	if c.flushPending && chunk.epoch == c.flushEpoch {
+		c.flushPending = false
+		c.player.Flush()
+	}
+
+	if chunk.epoch == c.epoch {
+		return true
+	}
+
+	nextStart, ok := c.epochStarts[chunk.epoch+1]
+
+	if !ok {
+		return false
+	}
+
+	// Samples are still played until the next epoch starts
+	format := c.player.Format()
+	frames := format.Frames(time.Duration(nextStart - chunk.timestamp))
+	frameSize := int64(format.FrameSize())
+
+	if frames <= 0 {
+		return false
+	}
+
+	if frames*frameSize < int64(len(chunk.samples)) {
+		chunk.samples = chunk.samples[:frames*frameSize]
+	}
+
+	return true
+}
+
+func (c *Client) startEpoch(epoch int, timestamp int64) {
+	c.epoch = epoch
+	c.epochStarts[epoch] = timestamp
+
+	for oldEpoch := range c.epochStarts {
+		if oldEpoch < epoch-epochHistory {
+			delete(c.epochStarts, oldEpoch)
+		}
+	}
 }
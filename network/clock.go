@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of measurements used to estimate the offset
+const clockSampleCount = 8
+
+// clock estimates the offset between the local and the server's clock
+type clock struct {
+	mutex   sync.RWMutex
+	samples []clockSample
+	offset  int64
+	delay   int64
+}
+
+type clockSample struct {
+	offset int64
+	delay  int64
+}
+
+// now returns the current time in nanoseconds
+func now() int64 {
+	return time.Now().UnixNano()
+}
+
+// update adds the timestamps of a request/response exchange (NTP-style)
+func (c *clock) update(requestTime, receiveTime, sendTime, responseTime int64) {
+	sample := clockSample{
+		offset: ((receiveTime - requestTime) + (sendTime - responseTime)) / 2,
+		delay:  (responseTime - requestTime) - (sendTime - receiveTime),
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.samples = append(c.samples, sample)
+
+	if len(c.samples) > clockSampleCount {
+		c.samples = c.samples[1:]
+	}
+
+	// Measurement with the smallest round-trip delay is the most accurate
+	best := c.samples[0]
+
+	for _, sample := range c.samples[1:] {
+		if sample.delay < best.delay {
+			best = sample
+		}
+	}
+
+	c.offset = best.offset
+	c.delay = best.delay
+}
+
+// synchronized returns whether at least one measurement was made
+func (c *clock) synchronized() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return len(c.samples) > 0
+}
+
+// roundTrip returns the round-trip delay of the current estimate
+func (c *clock) roundTrip() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return time.Duration(c.delay)
+}
+
+// localTime converts a server timestamp to the local clock
+func (c *clock) localTime(serverTime int64) int64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return serverTime - c.offset
+}
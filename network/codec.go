@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/medusalix/multispeaker/audio"
+)
+
+// Codec specifies how the samples of the stream are encoded
+type Codec int
+
+const (
+	// CodecPCM sends uncompressed samples
+	CodecPCM Codec = iota
+	// CodecLossless compresses the samples without losing quality
+	CodecLossless
+)
+
+var codecNames = []string{"pcm", "lossless"}
+
+// Codecs every client is able to decode
+var supportedCodecs = []Codec{CodecPCM, CodecLossless}
+
+// ParseCodec returns the codec with the given name
+func ParseCodec(name string) (Codec, error) {
+	for i, codecName := range codecNames {
+		if strings.EqualFold(name, codecName) {
+			return Codec(i), nil
+		}
+	}
+
+	return CodecPCM, fmt.Errorf("unknown codec '%s'", name)
+}
+
+func (c Codec) String() string {
+	if c < 0 || int(c) >= len(codecNames) {
+		return fmt.Sprintf("codec %d", int(c))
+	}
+
+	return codecNames[c]
+}
+
+// codecMask returns a bit mask of the given codecs
+func codecMask(codecs []Codec) byte {
+	var mask byte
+
+	for _, codec := range codecs {
+		mask |= 1 << uint(codec)
+	}
+
+	return mask
+}
+
+// encodeSamples compresses samples (16 bit) with the codec
+func encodeSamples(codec Codec, samples []byte, channels int) []byte {
+	if codec == CodecLossless {
+		return audio.EncodeLossless(samples, channels)
+	}
+
+	return samples
+}
+
+// decodeSamples restores samples compressed with the codec
+func decodeSamples(codec Codec, data []byte, channels int) ([]byte, error) {
+	switch codec {
+	case CodecPCM:
+		return data, nil
+	case CodecLossless:
+		return audio.DecodeLossless(data, channels)
+	}
+
+	return nil, fmt.Errorf("unsupported %s", codec)
+}
+
+// withCodec returns the chunk as it is streamed using the codec
+func (p *chunkPacket) withCodec(codec Codec) *chunkPacket {
+	if codec == CodecPCM {
+		return p
+	}
+
+	return &chunkPacket{
+		epoch:     p.epoch,
+		timestamp: p.timestamp,
+		samples:   p.encoded,
+	}
+}
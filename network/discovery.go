@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"net"
+	"time"
+
+	"github.com/medusalix/multispeaker/log"
+)
+
+const (
+	// Port the server answers discovery requests on
+	discoveryPort = 12344
+	// Time for servers to answer a discovery request
+	discoveryTimeout = time.Second
+	// Maximum length of the server name
+	maxServerNameLength = 255
+)
+
+// discoveredServer is a server that answered a discovery request
+type discoveredServer struct {
+	name        string
+	controlAddr *net.TCPAddr
+	streamAddr  *net.TCPAddr
+}
+
+// answerDiscovery responds to discovery requests until the connection is closed
+func answerDiscovery(conn *net.UDPConn, info *serverInfoPacket) {
+	buffer := make([]byte, bufferSize)
+	response := make([]byte, bufferSize)
+
+	size, err := encodePacket(response, info)
+
+	if err != nil {
+		log.Error("Unable to encode server info: ", err)
+
+		return
+	}
+
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			return
+		}
+
+		packet, err := decodePacket(buffer[:n])
+
+		if _, ok := packet.(*discoverPacket); err != nil || !ok {
+			continue
+		}
+
+		log.Debugf("Answering discovery request from '%s'", addr)
+
+		if _, err := conn.WriteToUDP(response[:size], addr); err != nil {
+			log.Debug("Unable to answer discovery request: ", err)
+		}
+	}
+}
+
+// discoverServers broadcasts a discovery request and collects the answers
+func discoverServers() ([]*discoveredServer, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	request := make([]byte, bufferSize)
+	size, err := encodePacket(request, &discoverPacket{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var sendErr error
+	sent := false
+
+	for _, ip := range broadcastAddrs() {
+		addr := &net.UDPAddr{
+			IP:   ip,
+			Port: discoveryPort,
+		}
+
+		// Some interfaces don't allow broadcasting
+		if _, err := conn.WriteToUDP(request[:size], addr); err != nil {
+			sendErr = err
+
+			continue
+		}
+
+		sent = true
+	}
+
+	if !sent {
+		return nil, sendErr
+	}
+
+	conn.SetReadDeadline(time.Now().Add(discoveryTimeout))
+
+	servers := make([]*discoveredServer, 0)
+	buffer := make([]byte, bufferSize)
+
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+
+		// Timeout has expired
+		if err != nil {
+			return servers, nil
+		}
+
+		packet, err := decodePacket(buffer[:n])
+		info, ok := packet.(*serverInfoPacket)
+
+		if err != nil || !ok {
+			continue
+		}
+
+		server := &discoveredServer{
+			name:        info.name,
+			controlAddr: &net.TCPAddr{IP: addr.IP, Port: info.controlPort},
+			streamAddr:  &net.TCPAddr{IP: addr.IP, Port: info.streamPort},
+		}
+
+		// Request reaches a server on each of its interfaces
+		if !containsServer(servers, server) {
+			servers = append(servers, server)
+		}
+	}
+}
+
+// broadcastAddrs returns the broadcast addresses of all IPv4 networks
+func broadcastAddrs() []net.IP {
+	addrs := []net.IP{net.IPv4bcast}
+	interfaces, err := net.Interfaces()
+
+	if err != nil {
+		return addrs
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		ifaceAddrs, err := iface.Addrs()
+
+		if err != nil {
+			continue
+		}
+
+		for _, ifaceAddr := range ifaceAddrs {
+			network, ok := ifaceAddr.(*net.IPNet)
+
+			if !ok || network.IP.To4() == nil {
+				continue
+			}
+
+			ip := network.IP.To4()
+			mask := net.IP(network.Mask).To4()
+
+			if mask == nil {
+				continue
+			}
+
+			broadcast := make(net.IP, net.IPv4len)
+
+			for i := range broadcast {
+				broadcast[i] = ip[i] | ^mask[i]
+			}
+
+			addrs = append(addrs, broadcast)
+		}
+	}
+
+	return addrs
+}
+
+func containsServer(servers []*discoveredServer, server *discoveredServer) bool {
+	for _, s := range servers {
+		if s.name == server.name && s.controlAddr.Port == server.controlAddr.Port {
+			return true
+		}
+	}
+
+	return false
+}
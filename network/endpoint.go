@@ -17,95 +17,386 @@
 package network
 
 import (
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"github.com/medusalix/multispeaker/audio"
 	"github.com/medusalix/multispeaker/log"
 )
 
 type endpoint struct {
-	ip            net.IP
+	id            string
 	name          string
+	token         []byte
+	capabilities  *helloPacket
+	codec         Codec
+	multicastAddr string
 	statusChanged statusCallback
+	bufferChanged bufferCallback
 	control       *protocol
-	stream        *protocol
-	samples       chan []byte
+	// Stream is connected and disconnected while packets are streamed
+	sender      *streamSender
+	senderMutex sync.Mutex
+	// Whether previous chunks are still being sent after joining
+	joining bool
+	// Last chunk sent on the stream
+	lastEpoch     int
+	lastTimestamp int64
+	// Duration of the samples the client aims to buffer
+	bufferTarget time.Duration
+	// Time after which a silent client is disconnected
+	timeout   time.Duration
+	roundTrip time.Duration
 }
 
+var (
+	errNoVolumeControl = errors.New("client is unable to change the volume")
+	errNoMute          = errors.New("client is unable to mute")
+)
+
 type statusCallback func(endpoint *endpoint, connected bool)
 
-func newEndpoint(conn net.Conn, statusChanged statusCallback) *endpoint {
+type bufferCallback func(endpoint *endpoint, report *bufferPacket)
+
+func newEndpoint(conn net.Conn, multicastAddr string, timeout time.Duration,
+	statusChanged statusCallback, bufferChanged bufferCallback) *endpoint {
 	endpoint := &endpoint{
-		ip:            conn.RemoteAddr().(*net.TCPAddr).IP,
 		control:       newProtocol(conn),
+		multicastAddr: multicastAddr,
 		statusChanged: statusChanged,
+		bufferChanged: bufferChanged,
+		timeout:       timeout,
 	}
 
-	go endpoint.listen()
-
 	return endpoint
 }
 
-func (e *endpoint) connectStream(conn net.Conn) {
-	e.stream = newProtocol(conn)
-	e.samples = make(chan []byte)
+func (e *endpoint) connectStream(conn net.Conn, policy SlowClientPolicy) {
+	e.senderMutex.Lock()
+	e.sender = newStreamSender(e.name, newProtocol(conn), policy)
+	e.senderMutex.Unlock()
+
+	e.lastEpoch = 0
+	e.lastTimestamp = 0
 }
 
 func (e *endpoint) disconnectStream() error {
-	if e.stream == nil {
+	e.senderMutex.Lock()
+	sender := e.sender
+	e.sender = nil
+	e.senderMutex.Unlock()
+
+	if sender == nil {
 		return nil
 	}
 
-	err := e.stream.close()
-	e.stream = nil
+	return sender.close()
+}
+
+// hasStream checks if the stream is connected
+func (e *endpoint) hasStream() bool {
+	sender := e.currentSender()
+
+	return sender != nil && !sender.closed()
+}
+
+// currentSender returns the sender of the connected stream (nil if disconnected)
+func (e *endpoint) currentSender() *streamSender {
+	e.senderMutex.Lock()
+	defer e.senderMutex.Unlock()
 
-	return err
+	return e.sender
 }
 
-func (e *endpoint) streamSamples(samples []byte) error {
-	if e.stream == nil {
+func (e *endpoint) streamPacket(packet packet) error {
+	// Joining endpoints receive the previous chunks first
+	if _, ok := packet.(*chunkPacket); ok && e.joining {
 		return nil
 	}
 
-	_, err := e.stream.sendRaw(samples)
+	return e.sendStream(packet, false)
+}
 
-	if err != nil {
-		e.stream = nil
+// sendStream queues a packet for the stream, wait ignores the slow client policy
+func (e *endpoint) sendStream(packet packet, wait bool) error {
+	// Stream might be disconnected in the meantime
+	sender := e.currentSender()
+
+	if sender == nil || sender.closed() {
+		return nil
 	}
 
-	return err
+	if chunk, ok := packet.(*chunkPacket); ok {
+		// Chunk was already sent when joining
+		if e.hasSent(chunk) {
+			return nil
+		}
+
+		e.lastEpoch = chunk.epoch
+		e.lastTimestamp = chunk.timestamp
+
+		packet = chunk.withCodec(e.codec)
+	}
+
+	return sender.queue(packet, wait)
+}
+
+// hasSent checks if the chunk or a later one was sent on the stream
+func (e *endpoint) hasSent(chunk *chunkPacket) bool {
+	return chunk.epoch < e.lastEpoch || chunk.epoch == e.lastEpoch && chunk.timestamp <= e.lastTimestamp
 }
 
-func (e *endpoint) preparePlayback(sampleRate int) error {
+func (e *endpoint) preparePlayback(format audio.Format, codec Codec) error {
+	if format.SampleRate > 0 && !e.capabilities.supportsSampleRate(format.SampleRate) {
+		return fmt.Errorf("sample rate of %d Hz is not supported", format.SampleRate)
+	}
+
+	if format.SampleRate > 0 && !e.capabilities.supportsChannels(format.Channels) {
+		return fmt.Errorf("%d channels are not supported", format.Channels)
+	}
+
+	if format.SampleRate > 0 && !e.supportsCodec(codec) {
+		return fmt.Errorf("%s codec is not supported", codec)
+	}
+
+	e.codec = codec
+
 	return e.control.send(&preparePacket{
-		sampleRate: sampleRate,
+		format: format,
+		codec:  codec,
+	})
+}
+
+// supportsCodec checks if the client is able to decode the codec
+func (e *endpoint) supportsCodec(codec Codec) bool {
+	return e.capabilities.codecs&codecMask([]Codec{codec}) != 0
+}
+
+func (e *endpoint) pausePlayback(paused bool, epoch int, timestamp int64) error {
+	return e.control.send(&pausePacket{
+		paused:    paused,
+		epoch:     epoch,
+		timestamp: timestamp,
+	})
+}
+
+func (e *endpoint) flushPlayback(epoch int, timestamp int64) error {
+	return e.control.send(&flushPacket{
+		epoch:     epoch,
+		timestamp: timestamp,
 	})
 }
 
 func (e *endpoint) changeVolume(volume int) error {
+	if !e.capabilities.volumeControl {
+		return errNoVolumeControl
+	}
+
 	return e.control.send(&volumePacket{
 		volume: volume,
 	})
 }
 
+func (e *endpoint) mute(muted bool) error {
+	if !e.capabilities.volumeControl {
+		return errNoMute
+	}
+
+	return e.control.send(&mutePacket{
+		muted: muted,
+	})
+}
+
+func (e *endpoint) mapChannels(mapping audio.ChannelMap) error {
+	return e.control.send(&channelMapPacket{
+		mapping: mapping,
+	})
+}
+
+// announceTrack tells the client which track is played
+func (e *endpoint) announceTrack(metadata audio.Metadata) error {
+	return e.control.send(&metadataPacket{
+		title:    truncateString(metadata.Title, maxMetadataLength),
+		artist:   truncateString(metadata.Artist, maxMetadataLength),
+		album:    truncateString(metadata.Album, maxMetadataLength),
+		duration: int64(metadata.Duration),
+	})
+}
+
+// repeatTrack sends the track packet of a multicast datagram on the control connection
+func (e *endpoint) repeatTrack(sequence uint32, track *trackPacket) error {
+	return e.control.send(&repeatTrackPacket{
+		sequence: sequence,
+		track:    *track,
+	})
+}
+
+// accept assigns a token for the stream connection
+func (e *endpoint) accept(id string, name string) error {
+	token := make([]byte, tokenSize)
+
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+
+	e.id = id
+	e.name = name
+	e.token = token
+
+	return e.control.send(&acceptPacket{
+		token:         token,
+		multicastAddr: e.multicastAddr,
+	})
+}
+
+// goodbye tells the client that the server is shutting down and closes the connection
+func (e *endpoint) goodbye(reason string, reconnectDelay time.Duration) error {
+	err := e.control.send(&goodbyePacket{
+		reconnectDelay: int64(reconnectDelay),
+		reason:         reason,
+	})
+
+	if err != nil {
+		e.close()
+
+		return err
+	}
+
+	// Closing with unread packets resets the connection, discarding the goodbye,
+	// the client closes it after receiving the packet instead
+	return e.control.closeWrite()
+}
+
+func (e *endpoint) close() error {
+	return e.control.close()
+}
+
+// handshake checks the client's hello packet and answers it
+func (e *endpoint) handshake() error {
+	e.control.conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	packet, err := e.control.receive()
+	e.control.conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		return handshakeError(err, "client")
+	}
+
+	hello, ok := packet.(*helloPacket)
+
+	if !ok {
+		return errors.New("client didn't start with a hello packet")
+	}
+
+	err = checkHello(hello, "client")
+
+	if err == nil && !hello.supportsChannels(defaultChannels) {
+		err = errors.New("client is unable to play stereo samples")
+	}
+
+	if err != nil {
+		// Client is told why it can't connect
+		e.control.send(&refusePacket{
+			reason: err.Error(),
+		})
+
+		return err
+	}
+
+	e.capabilities = hello
+
+	return e.control.send(newHelloPacket(false, nil))
+}
+
 func (e *endpoint) listen() {
+	if err := e.handshake(); err != nil {
+		log.Infof("Refused client '%s': %s", e.control.conn.RemoteAddr(), err)
+		e.control.close()
+
+		return
+	}
+
+	go sendPings(e.control)
+
 	for {
-		packet, err := e.control.receive()
+		packet, err := receiveAlive(e.control, e.timeout)
 
 		if err != nil {
+			if isTimeout(err) {
+				name := e.name
+
+				if name == "" {
+					name = e.control.conn.RemoteAddr().String()
+				}
+
+				log.Infof("Client '%s' didn't respond for %s", name, e.timeout)
+			}
+
+			// Connection might still be open if the client vanished
+			e.control.close()
+
 			if err := e.disconnectStream(); err != nil {
 				log.Error("Error disconnecting stream: ", err)
 			}
 
-			// Notify server of disconnect
-			e.statusChanged(e, false)
+			// Notify server of disconnect if announced
+			if e.token != nil {
+				e.statusChanged(e, false)
+			}
 
 			return
 		}
 
 		switch p := packet.(type) {
 		case *announcePacket:
-			e.name = p.name
+			if err := e.accept(p.id, p.name); err != nil {
+				log.Error("Error accepting endpoint: ", err)
+
+				continue
+			}
+
 			e.statusChanged(e, true)
+		case *timeRequestPacket:
+			receiveTime := now()
+
+			err := e.control.send(&timeResponsePacket{
+				clientTime:  p.clientTime,
+				receiveTime: receiveTime,
+				sendTime:    now(),
+			})
+
+			// Client was told goodbye, its requests aren't answered anymore
+			if err != nil && err != errWriteClosed {
+				log.Error("Error answering time request: ", err)
+			}
+		case *pingPacket:
+			if err := answerPing(e.control, p); err != nil && err != errWriteClosed {
+				log.Error("Error answering ping: ", err)
+			}
+		case *pongPacket:
+			e.roundTrip = time.Duration(now() - p.sendTime)
+		case *bufferPacket:
+			// Reports are only valid after announcing
+			if e.token != nil {
+				e.bufferChanged(e, p)
+			}
 		}
 	}
 }
+
+// truncateString shortens a string to the given number of bytes without splitting characters
+func truncateString(str string, length int) string {
+	if len(str) <= length {
+		return str
+	}
+
+	for length > 0 && !utf8.RuneStart(str[length]) {
+		length--
+	}
+
+	return str[:length]
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/medusalix/multispeaker/audio"
+)
+
+const (
+	// Identifies the multispeaker protocol ("MSPK")
+	protocolMagic = 0x4d53504b
+	// Version of the protocol, increased when packets are added or changed
+	protocolVersion = 1
+	// Oldest version that peers may use
+	minProtocolVersion = 1
+)
+
+// Time for the peer to send its hello packet
+const helloTimeout = time.Second * 5
+
+// Channel count that every peer is able to play
+const defaultChannels = 2
+
+// Sample rates the stream can be resampled to
+const (
+	minSampleRate = 8000
+	maxSampleRate = 192000
+)
+
+// Sample rates that sound devices commonly play, accepted by clients that don't resample
+var deviceSampleRates = []int{
+	8000, 11025, 12000, 16000, 22050, 24000, 32000,
+	44100, 48000, 64000, 88200, 96000, 176400, 192000,
+}
+
+// newHelloPacket describes the capabilities of this peer,
+// sample rates are empty if it plays any rate
+func newHelloPacket(volumeControl bool, sampleRates []int) *helloPacket {
+	return &helloPacket{
+		magic:         protocolMagic,
+		version:       protocolVersion,
+		minVersion:    minProtocolVersion,
+		sampleRates:   sampleRates,
+		channels:      supportedChannels(),
+		codecs:        codecMask(supportedCodecs),
+		volumeControl: volumeControl,
+	}
+}
+
+// supportedChannels lists the channel counts the player is able to mix
+func supportedChannels() []int {
+	channels := make([]int, audio.MaxChannels)
+
+	for i := range channels {
+		channels[i] = i + 1
+	}
+
+	return channels
+}
+
+// checkHello checks if the protocol version of the peer ("client" or "server") is compatible
+func checkHello(hello *helloPacket, peer string) error {
+	if hello.magic != protocolMagic {
+		return outdatedPeerError(peer)
+	}
+
+	if hello.version < minProtocolVersion {
+		return fmt.Errorf("%s uses protocol version %d, at least version %d is required",
+			peer, hello.version, minProtocolVersion)
+	}
+
+	if hello.minVersion > protocolVersion {
+		return fmt.Errorf("%s requires protocol version %d, only version %d is supported",
+			peer, hello.minVersion, protocolVersion)
+	}
+
+	return nil
+}
+
+// handshakeError explains errors receiving the hello packet
+func handshakeError(err error, peer string) error {
+	// Versions without handshake send other packets or don't answer
+	if _, ok := err.(*protocolError); ok {
+		return outdatedPeerError(peer)
+	}
+
+	if isTimeout(err) {
+		return outdatedPeerError(peer)
+	}
+
+	return err
+}
+
+// checkSampleRate checks if samples can be resampled to the rate (0 disables resampling)
+func checkSampleRate(sampleRate int) error {
+	if sampleRate != 0 && (sampleRate < minSampleRate || sampleRate > maxSampleRate) {
+		return fmt.Errorf("sample rate must be between %d and %d Hz", minSampleRate, maxSampleRate)
+	}
+
+	return nil
+}
+
+func outdatedPeerError(peer string) error {
+	return fmt.Errorf("%s doesn't use the multispeaker protocol or is outdated", peer)
+}
+
+// supportsChannels checks if the peer can play the channel count
+func (p *helloPacket) supportsChannels(channels int) bool {
+	for _, c := range p.channels {
+		if c == channels {
+			return true
+		}
+	}
+
+	return false
+}
+
+// supportsSampleRate checks if the peer can play the sample rate
+func (p *helloPacket) supportsSampleRate(sampleRate int) bool {
+	if len(p.sampleRates) == 0 {
+		return true
+	}
+
+	for _, rate := range p.sampleRates {
+		if rate == sampleRate {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultHeartbeatTimeout is the time after which a silent peer is considered dead by default
+const DefaultHeartbeatTimeout = time.Second * 5
+
+const (
+	// Interval between the pings
+	heartbeatInterval = time.Second
+	// Shortest timeout, the peer might also only answer the clock synchronization
+	minHeartbeatTimeout = heartbeatInterval * 3
+)
+
+// sendPings pings the peer until the connection is closed
+func sendPings(control *protocol) {
+	for {
+		time.Sleep(heartbeatInterval)
+
+		if err := control.send(&pingPacket{sendTime: now()}); err != nil {
+			return
+		}
+	}
+}
+
+// answerPing sends the pong for a received ping
+func answerPing(control *protocol, ping *pingPacket) error {
+	return control.send(&pongPacket{
+		sendTime: ping.sendTime,
+	})
+}
+
+// receiveAlive receives the next packet, failing if the peer is silent for too long
+func receiveAlive(control *protocol, timeout time.Duration) (packet, error) {
+	control.conn.SetReadDeadline(time.Now().Add(timeout))
+
+	return control.receive()
+}
+
+func checkHeartbeatTimeout(timeout time.Duration) error {
+	if timeout < minHeartbeatTimeout {
+		return fmt.Errorf("timeout must be at least %s", minHeartbeatTimeout)
+	}
+
+	return nil
+}
+
+// isTimeout checks if the peer didn't send anything in time
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"sync"
+	"time"
+
+	"github.com/medusalix/multispeaker/audio"
+)
+
+// DefaultBufferTarget is the duration of the samples clients aim to buffer by default
+const DefaultBufferTarget = time.Millisecond * 200
+
+const (
+	// Shortest buffer target, covers the player's buffer
+	minBufferTarget = time.Millisecond * 50
+	// Interval between the buffer reports
+	bufferReportInterval = time.Second
+	// Duration of the silence played while waiting for samples
+	silenceDuration = time.Millisecond * 10
+)
+
+// jitterBuffer holds the received packets until they are played
+// and bridges gaps in the stream with silence
+type jitterBuffer struct {
+	packets chan packet
+	target  time.Duration
+	// Received samples, used for the reports
+	mutex         sync.Mutex
+	format        audio.Format
+	receivedUntil int64
+	underruns     int
+	// Local time at which the written samples end
+	playedUntil int64
+	// Local time at which the last chunk ends
+	chunkEnd int64
+	// Whether silence was played since the last chunk
+	silent bool
+	// Whether the current gap was counted as an underrun
+	counted bool
+}
+
+func newJitterBuffer(target time.Duration, format audio.Format) *jitterBuffer {
+	return &jitterBuffer{
+		packets: make(chan packet, chunkQueueSize),
+		target:  target,
+		format:  format,
+	}
+}
+
+// push adds a received packet to the buffer
+func (b *jitterBuffer) push(packet packet) {
+	b.mutex.Lock()
+
+	switch p := packet.(type) {
+	case *chunkPacket:
+		frames := int64(len(p.samples) / b.format.FrameSize())
+		end := p.timestamp + int64(b.format.Duration(frames))
+
+		if end > b.receivedUntil {
+			b.receivedUntil = end
+		}
+	case *trackPacket:
+		b.format = p.format
+	}
+
+	b.mutex.Unlock()
+
+	b.packets <- packet
+}
+
+// flush resets the received samples, the next ones start at the timestamp
+func (b *jitterBuffer) flush(timestamp int64) {
+	b.mutex.Lock()
+	b.receivedUntil = timestamp
+	b.mutex.Unlock()
+}
+
+func (b *jitterBuffer) close() {
+	close(b.packets)
+}
+
+// report describes the fill level and resets the underruns
+func (b *jitterBuffer) report(clock *clock) *bufferPacket {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	fill := clock.localTime(b.receivedUntil) - now()
+
+	if fill < 0 {
+		fill = 0
+	}
+
+	report := &bufferPacket{
+		target:    int64(b.target),
+		fill:      fill,
+		underruns: b.underruns,
+	}
+	b.underruns = 0
+
+	return report
+}
+
+// next returns the next packet or nil if silence needs to be played first,
+// ok is false once the stream is closed
+func (b *jitterBuffer) next(latency time.Duration) (packet, bool) {
+	// Received packets are played before filling gaps
+	select {
+	case packet, ok := <-b.packets:
+		return packet, ok
+	default:
+	}
+
+	var silence <-chan time.Time
+
+	// Player runs out of samples unless the next packet arrives in time
+	if delay, ok := b.silenceDelay(latency); ok {
+		silence = time.After(delay)
+	}
+
+	select {
+	case packet, ok := <-b.packets:
+		return packet, ok
+	case <-silence:
+		return nil, true
+	}
+}
+
+// silenceDelay returns the time until the player runs out of samples,
+// gaps longer than the target are pauses and aren't filled
+func (b *jitterBuffer) silenceDelay(latency time.Duration) (time.Duration, bool) {
+	if b.chunkEnd == 0 || b.playedUntil >= b.chunkEnd+int64(b.target) {
+		return 0, false
+	}
+
+	return time.Duration(b.playedUntil - int64(latency) - now()), true
+}
+
+// wroteSilence advances the written samples by the played silence
+func (b *jitterBuffer) wroteSilence(duration time.Duration) {
+	b.playedUntil += int64(duration)
+	b.silent = true
+}
+
+// late counts an underrun if the chunk missed its time because the buffer ran empty
+func (b *jitterBuffer) late() {
+	if !b.silent || b.counted {
+		return
+	}
+
+	b.mutex.Lock()
+	b.underruns++
+	b.mutex.Unlock()
+
+	b.counted = true
+}
+
+// wroteChunk advances the written samples to the end of the chunk
+func (b *jitterBuffer) wroteChunk(end int64) {
+	b.playedUntil = end
+	b.chunkEnd = end
+	b.silent = false
+	b.counted = false
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+const testTarget = time.Millisecond * 50
+
+// nextPacket returns the next packet of the buffer, ok is false if it waits for one
+func nextPacket(buffer *jitterBuffer) (packet, bool) {
+	result := make(chan packet, 1)
+
+	go func() {
+		packet, _ := buffer.next(0)
+		result <- packet
+	}()
+
+	select {
+	case packet := <-result:
+		return packet, true
+	case <-time.After(time.Millisecond * 100):
+		// Unblock the waiting buffer, the chunk is discarded
+		buffer.push(testChunk(0))
+		<-result
+
+		return nil, false
+	}
+}
+
+// Silence is played when the buffer runs empty, gaps longer than the target are pauses
+func TestJitterBufferSilence(t *testing.T) {
+	buffer := newJitterBuffer(testTarget, testFormat)
+
+	// Stream hasn't started yet
+	if _, ok := nextPacket(buffer); ok {
+		t.Fatal("Silence played before the first chunk")
+	}
+
+	// Chunk ended in the past, the player runs out of samples
+	buffer.wroteChunk(now() - int64(time.Second))
+	silences := 0
+
+	for {
+		packet, ok := nextPacket(buffer)
+
+		if !ok {
+			break
+		}
+
+		if packet != nil {
+			t.Fatal("Unexpected packet: ", packet)
+		}
+
+		buffer.wroteSilence(silenceDuration)
+		silences++
+	}
+
+	if expected := int(testTarget / silenceDuration); silences != expected {
+		t.Errorf("Expected %d silences, got %d", expected, silences)
+	}
+
+	// Received chunks are played instead of silence
+	buffer.wroteChunk(now() - int64(time.Second))
+	buffer.push(testChunk(1))
+
+	if packet, _ := nextPacket(buffer); packet == nil {
+		t.Error("Silence played while a chunk was buffered")
+	}
+}
+
+// Underruns are counted once per gap and reset by the reports
+func TestJitterBufferUnderruns(t *testing.T) {
+	buffer := newJitterBuffer(testTarget, testFormat)
+	clock := &clock{}
+
+	// Late chunks without silence didn't run the buffer empty
+	buffer.wroteChunk(now())
+	buffer.late()
+
+	for i := 0; i < 2; i++ {
+		buffer.wroteSilence(silenceDuration)
+		buffer.late()
+		buffer.late()
+		buffer.wroteChunk(now())
+	}
+
+	if report := buffer.report(clock); report.underruns != 2 {
+		t.Errorf("Expected 2 underruns, got %d", report.underruns)
+	}
+
+	if report := buffer.report(clock); report.underruns != 0 {
+		t.Errorf("Underruns weren't reset, got %d", report.underruns)
+	}
+}
+
+// Fill level covers the received samples that haven't been played yet
+func TestJitterBufferReport(t *testing.T) {
+	buffer := newJitterBuffer(testTarget, testFormat)
+	clock := &clock{offset: int64(time.Hour)}
+
+	if report := buffer.report(clock); report.fill != 0 || report.target != int64(testTarget) {
+		t.Errorf("Unexpected report of empty buffer: %+v", report)
+	}
+
+	// Chunk of 100ms received 100ms ahead
+	start := now() + int64(clock.offset) + int64(time.Millisecond*100)
+	chunk := testChunk(0)
+	chunk.timestamp = start
+	chunk.samples = make([]byte, testFormat.Frames(time.Millisecond*100)*int64(testFormat.FrameSize()))
+	buffer.push(chunk)
+
+	fill := time.Duration(buffer.report(clock).fill)
+
+	if fill < time.Millisecond*150 || fill > time.Millisecond*200 {
+		t.Errorf("Expected fill of about 200ms, got %s", fill)
+	}
+
+	// Flushed samples aren't counted, the next ones start in the past
+	buffer.flush(start - int64(time.Second))
+
+	if fill := buffer.report(clock).fill; fill != 0 {
+		t.Errorf("Expected empty buffer after flushing, got %s", time.Duration(fill))
+	}
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/medusalix/multispeaker/audio"
+	"github.com/medusalix/multispeaker/log"
+)
+
+const (
+	// Datagrams start with a sequence number
+	sequenceSize = 4
+	// Number of datagrams received after a gap until it is concealed
+	reorderWindow = 8
+	// Difference in sequence numbers after which the stream is restarted
+	maxSequenceJump = 1024
+)
+
+// multicastSender sends stream packets to a multicast group
+type multicastSender struct {
+	conn     *net.UDPConn
+	sequence uint32
+	buffer   []byte
+}
+
+func newMulticastSender(group *net.UDPAddr) (*multicastSender, error) {
+	conn, err := net.DialUDP("udp", nil, group)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &multicastSender{
+		conn:   conn,
+		buffer: make([]byte, sequenceSize+bufferSize),
+	}, nil
+}
+
+func (s *multicastSender) send(packet packet) error {
+	size, err := encodePacket(s.buffer[sequenceSize:], packet)
+
+	if err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(s.buffer, s.sequence)
+	s.sequence++
+
+	_, err = s.conn.Write(s.buffer[:sequenceSize+size])
+
+	return err
+}
+
+// nextSequence returns the sequence number of the next datagram
+func (s *multicastSender) nextSequence() uint32 {
+	return s.sequence
+}
+
+func (s *multicastSender) close() error {
+	return s.conn.Close()
+}
+
+// multicastReceiver restores the order of received stream packets
+// and conceals lost chunks
+type multicastReceiver struct {
+	conn      net.PacketConn
+	format    audio.Format
+	codec     Codec
+	started   bool
+	expected  uint32
+	pending   map[uint32]packet
+	lastChunk *chunkPacket
+	// Sequence number of the last track packet that was passed
+	lastTrack   uint32
+	passedTrack bool
+	repeatMutex sync.Mutex
+	repeated    map[uint32]*trackPacket
+}
+
+func newMulticastReceiver(group *net.UDPAddr, format audio.Format, codec Codec) (*multicastReceiver, error) {
+	conn, err := net.ListenMulticastUDP("udp", nil, group)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newPacketReceiver(conn, format, codec), nil
+}
+
+// newPacketReceiver receives the stream packets from any connection
+func newPacketReceiver(conn net.PacketConn, format audio.Format, codec Codec) *multicastReceiver {
+	return &multicastReceiver{
+		conn:     conn,
+		format:   format,
+		codec:    codec,
+		pending:  make(map[uint32]packet),
+		repeated: make(map[uint32]*trackPacket),
+	}
+}
+
+// receive passes the packets in order until the receiver is closed
+func (r *multicastReceiver) receive(packets *jitterBuffer) {
+	buffer := make([]byte, sequenceSize+bufferSize)
+
+	for {
+		n, _, err := r.conn.ReadFrom(buffer)
+
+		if err != nil {
+			return
+		}
+
+		if n < sequenceSize {
+			continue
+		}
+
+		received, err := decodePacket(buffer[sequenceSize:n])
+
+		if err != nil {
+			log.Debug("Invalid multicast datagram: ", err)
+
+			continue
+		}
+
+		r.reorder(binary.BigEndian.Uint32(buffer), received, packets)
+	}
+}
+
+func (r *multicastReceiver) reorder(sequence uint32, received packet, packets *jitterBuffer) {
+	distance := int32(sequence - r.expected)
+
+	// Server was restarted or datagrams were lost for a long time
+	if !r.started || distance > maxSequenceJump || distance < -maxSequenceJump {
+		r.started = true
+		r.expected = sequence
+		r.pending = make(map[uint32]packet)
+		distance = 0
+	}
+
+	// Track of a lost datagram was repeated after the datagram was concealed
+	if track, trackSequence, ok := r.missedTrack(); ok {
+		log.Debugf("Changing format of lost datagram %d", trackSequence)
+
+		r.passTrack(trackSequence, track)
+		packets.push(track)
+	}
+
+	// Datagram arrived too late or twice
+	if distance < 0 {
+		return
+	}
+
+	r.pending[sequence] = received
+
+	for len(r.pending) > 0 {
+		next, ok := r.pending[r.expected]
+
+		if ok {
+			delete(r.pending, r.expected)
+		} else if track, repeated := r.repeatedTrack(r.expected); repeated {
+			// Datagram of the track packet isn't needed
+			next = track
+		} else if len(r.pending) >= reorderWindow {
+			log.Debugf("Concealing lost datagram %d", r.expected)
+
+			next = r.conceal()
+		} else {
+			// Wait for the missing datagram
+			return
+		}
+
+		current := r.expected
+		r.expected++
+
+		if next == nil {
+			continue
+		}
+
+		switch p := next.(type) {
+		case *chunkPacket:
+			var err error
+
+			// Chunks are decoded in order, a previous track might have had another format
+			if ok {
+				p.samples, err = decodeSamples(r.codec, p.samples, r.format.Channels)
+			}
+
+			if err != nil {
+				log.Debug("Unable to decode chunk: ", err)
+
+				continue
+			}
+
+			r.lastChunk = p
+		case *trackPacket:
+			r.passTrack(current, p)
+		}
+
+		packets.push(next)
+	}
+}
+
+// repeatTrack stores a track packet that was repeated on the control connection
+func (r *multicastReceiver) repeatTrack(sequence uint32, track *trackPacket) {
+	r.repeatMutex.Lock()
+	r.repeated[sequence] = track
+	r.repeatMutex.Unlock()
+}
+
+// repeatedTrack takes the repeated track packet of a datagram
+func (r *multicastReceiver) repeatedTrack(sequence uint32) (*trackPacket, bool) {
+	r.repeatMutex.Lock()
+	defer r.repeatMutex.Unlock()
+
+	track, ok := r.repeated[sequence]
+	delete(r.repeated, sequence)
+
+	return track, ok
+}
+
+// missedTrack returns the latest repeated track packet whose datagram
+// was already concealed, older ones are discarded
+func (r *multicastReceiver) missedTrack() (*trackPacket, uint32, bool) {
+	r.repeatMutex.Lock()
+	defer r.repeatMutex.Unlock()
+
+	var missed *trackPacket
+	var missedSequence uint32
+
+	for sequence, track := range r.repeated {
+		// Datagram hasn't been passed yet
+		if int32(sequence-r.expected) >= 0 {
+			continue
+		}
+
+		delete(r.repeated, sequence)
+
+		// Track was passed already or is outdated
+		if r.passedTrack && int32(sequence-r.lastTrack) <= 0 {
+			continue
+		}
+
+		if missed == nil || int32(sequence-missedSequence) > 0 {
+			missed = track
+			missedSequence = sequence
+		}
+	}
+
+	return missed, missedSequence, missed != nil
+}
+
+// passTrack changes the format of the following chunks
+func (r *multicastReceiver) passTrack(sequence uint32, track *trackPacket) {
+	// Previous chunk can't conceal chunks of another format
+	if track.format != r.format {
+		r.lastChunk = nil
+	}
+
+	r.format = track.format
+	r.lastTrack = sequence
+	r.passedTrack = true
+}
+
+// conceal repeats the previous chunk in place of a lost one
+func (r *multicastReceiver) conceal() packet {
+	if r.lastChunk == nil {
+		return nil
+	}
+
+	frames := int64(len(r.lastChunk.samples) / r.format.FrameSize())
+
+	return &chunkPacket{
+		epoch:     r.lastChunk.epoch,
+		timestamp: r.lastChunk.timestamp + int64(r.format.Duration(frames)),
+		samples:   r.lastChunk.samples,
+	}
+}
+
+func (r *multicastReceiver) close() error {
+	return r.conn.Close()
+}
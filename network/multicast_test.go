@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/medusalix/multispeaker/audio"
+)
+
+var testFormat = audio.Format{SampleRate: 48000, Channels: 2, BitDepth: 16}
+
+const testFrames = 4
+
+// testChunk returns a chunk that can be identified by its index
+func testChunk(index int) *chunkPacket {
+	return &chunkPacket{
+		timestamp: int64(index) * int64(testFormat.Duration(testFrames)),
+		samples:   bytes.Repeat([]byte{byte(index + 1)}, testFrames*testFormat.FrameSize()),
+	}
+}
+
+type testDatagram struct {
+	sequence uint32
+	chunk    int
+}
+
+type playedChunk struct {
+	// Index of the chunk's timestamp
+	chunk int
+	// Index of the chunk the samples belong to
+	samples int
+}
+
+// Datagrams are sent over loopback and passed to the jitter buffer in order
+func TestMulticastReceiver(t *testing.T) {
+	tests := []struct {
+		name      string
+		datagrams []testDatagram
+		played    []playedChunk
+	}{
+		{
+			"in order",
+			[]testDatagram{{0, 0}, {1, 1}, {2, 2}},
+			[]playedChunk{{0, 0}, {1, 1}, {2, 2}},
+		},
+		{
+			"reordered",
+			[]testDatagram{{0, 0}, {2, 2}, {3, 3}, {1, 1}, {5, 5}, {4, 4}},
+			[]playedChunk{{0, 0}, {1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 5}},
+		},
+		{
+			"duplicated",
+			[]testDatagram{{0, 0}, {1, 1}, {1, 1}, {0, 0}, {2, 2}, {2, 2}},
+			[]playedChunk{{0, 0}, {1, 1}, {2, 2}},
+		},
+		{
+			// Lost datagram arrives after it was concealed
+			"concealed gap",
+			[]testDatagram{
+				{0, 0}, {2, 2}, {3, 3}, {4, 4}, {5, 5}, {6, 6}, {7, 7}, {8, 8}, {9, 9}, {1, 1}, {10, 10},
+			},
+			[]playedChunk{
+				{0, 0}, {1, 0}, {2, 2}, {3, 3}, {4, 4}, {5, 5}, {6, 6}, {7, 7}, {8, 8}, {9, 9}, {10, 10},
+			},
+		},
+		{
+			"sequence wraparound",
+			[]testDatagram{{0xfffffffe, 0}, {0, 2}, {0xffffffff, 1}, {2, 4}, {1, 3}},
+			[]playedChunk{{0, 0}, {1, 1}, {2, 2}, {3, 3}, {4, 4}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			played := receiveDatagrams(t, test.datagrams, len(test.played))
+
+			for i, chunk := range test.played {
+				expected := testChunk(chunk.chunk)
+				expected.samples = testChunk(chunk.samples).samples
+
+				if played[i].timestamp != expected.timestamp || !bytes.Equal(played[i].samples, expected.samples) {
+					t.Errorf("Chunk %d: expected %+v, got %+v", i, expected, played[i])
+				}
+			}
+		})
+	}
+}
+
+// receiveDatagrams sends the datagrams to a receiver and returns the chunks it passes
+func receiveDatagrams(t *testing.T, datagrams []testDatagram, count int) []*chunkPacket {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Unable to listen: ", err)
+	}
+
+	sender, err := net.Dial("udp", conn.LocalAddr().String())
+
+	if err != nil {
+		t.Fatal("Unable to dial: ", err)
+	}
+
+	defer sender.Close()
+
+	receiver := newPacketReceiver(conn, testFormat, CodecPCM)
+	buffer := newJitterBuffer(DefaultBufferTarget, testFormat)
+	done := make(chan bool)
+
+	go func() {
+		receiver.receive(buffer)
+		close(done)
+	}()
+
+	data := make([]byte, sequenceSize+bufferSize)
+
+	for _, datagram := range datagrams {
+		size, err := encodePacket(data[sequenceSize:], testChunk(datagram.chunk))
+
+		if err != nil {
+			t.Fatal("Unable to encode chunk: ", err)
+		}
+
+		binary.BigEndian.PutUint32(data, datagram.sequence)
+
+		if _, err := sender.Write(data[:sequenceSize+size]); err != nil {
+			t.Fatal("Unable to send datagram: ", err)
+		}
+	}
+
+	played := make([]*chunkPacket, 0, count)
+
+	for len(played) < count {
+		select {
+		case packet := <-buffer.packets:
+			played = append(played, packet.(*chunkPacket))
+		case <-time.After(time.Second):
+			t.Fatalf("Received %d of %d chunks", len(played), count)
+		}
+	}
+
+	receiver.close()
+	<-done
+
+	// Datagrams left over from the test
+	select {
+	case packet := <-buffer.packets:
+		t.Errorf("Unexpected packet: %+v", packet)
+	default:
+	}
+
+	return played
+}
@@ -17,23 +17,85 @@
 package network
 
 import (
+	"encoding/binary"
 	"errors"
+	"io"
 	"net"
+	"sync"
+
+	"github.com/medusalix/multispeaker/audio"
 )
 
-const sendBufferSize = 1024
-const receiveBufferSize = 1024
+const (
+	// Packets start with their ID and size
+	headerSize = 3
+	// Largest packet that is sent or accepted
+	maxPacketSize = 16384
+	// Buffer holding a packet including its header
+	bufferSize = headerSize + maxPacketSize
+)
+
+// Largest number of sample bytes in a chunk, keeps datagrams below the MTU
+const maxChunkSize = 1024
+
+// Longest title, artist or album (in bytes) of the metadata packet
+const maxMetadataLength = 255
+
+// Length of the token used to attach stream connections
+const tokenSize = 16
 
 const (
-	announcePacketID = iota
+	// Handshake packets keep their IDs in all protocol versions
+	helloPacketID = iota
+	refusePacketID
+	announcePacketID
 	preparePacketID
 	controlPacketID
+	timeRequestPacketID
+	timeResponsePacketID
+	chunkPacketID
+	pausePacketID
+	flushPacketID
+	trackPacketID
+	acceptPacketID
+	attachPacketID
+	discoverPacketID
+	serverInfoPacketID
+	bufferPacketID
+	pingPacketID
+	pongPacketID
+	goodbyePacketID
+	channelMapPacketID
+	mutePacketID
+	metadataPacketID
+	repeatTrackPacketID
+)
+
+// protocolError is returned when a peer violates the protocol
+type protocolError struct {
+	message string
+}
+
+func (e *protocolError) Error() string {
+	return e.message
+}
+
+var (
+	errInvalidPacket  = &protocolError{"received invalid packet"}
+	errUnknownPacket  = &protocolError{"received packet with unknown id"}
+	errPacketTooLarge = &protocolError{"packet exceeds the maximum size"}
 )
 
+// Returned when sending after closing the connection for writing
+var errWriteClosed = errors.New("connection is closed for writing")
+
 type protocol struct {
 	conn          net.Conn
+	sendMutex     sync.Mutex
 	sendBuffer    []byte
 	receiveBuffer []byte
+	// Packets are refused after closing the connection for writing
+	writeClosed bool
 }
 
 type packet interface {
@@ -42,162 +104,869 @@ type packet interface {
 	size() int
 }
 
+// ................
+// Client <> Server
+// ................
+
+// helloPacket starts the handshake on the control connection
+type helloPacket struct {
+	// Identifies the multispeaker protocol
+	magic uint32
+	// Protocol version of the sender
+	version int
+	// Oldest protocol version the sender is compatible with
+	minVersion int
+	// Sample rates the sender can play (empty if any)
+	sampleRates []int
+	// Channel counts the sender can play
+	channels []int
+	// Bit mask of the supported codecs
+	codecs byte
+	// Whether the sender can change the system volume
+	volumeControl bool
+}
+
+// pingPacket checks if the peer is still reachable
+type pingPacket struct {
+	// Sender's time when sending the ping
+	sendTime int64
+}
+
+// pongPacket answers a ping
+type pongPacket struct {
+	// Time of the answered ping
+	sendTime int64
+}
+
 // ................
 // Client -> Server
 // ................
 
 // announcePacket notifies the server of a new client
 type announcePacket struct {
+	// Persistent unique ID of the client
+	id string
 	// Name of the client (username)
 	name string
 }
 
+// timeRequestPacket starts a clock synchronization
+type timeRequestPacket struct {
+	// Client time when sending the request
+	clientTime int64
+}
+
+// attachPacket assigns a stream connection to its control connection
+type attachPacket struct {
+	// Token received with the acceptPacket
+	token []byte
+}
+
+// discoverPacket searches for servers on the local network
+type discoverPacket struct {
+}
+
+// bufferPacket reports the fill level of the client's jitter buffer
+type bufferPacket struct {
+	// Duration of the samples the client aims to buffer
+	target int64
+	// Duration of the currently buffered samples
+	fill int64
+	// Number of times the buffer ran empty since the last report
+	underruns int
+}
+
 // ................
 // Server -> Client
 // ................
 
+// goodbyePacket tells the client that the server is shutting down
+type goodbyePacket struct {
+	// Time the client should wait before reconnecting
+	reconnectDelay int64
+	// Why the server is shutting down
+	reason string
+}
+
+// channelMapPacket sets which channels the client plays on its speakers
+type channelMapPacket struct {
+	mapping audio.ChannelMap
+}
+
+// mutePacket mutes the client's speakers, the volume is kept
+type mutePacket struct {
+	muted bool
+}
+
+// metadataPacket describes the track that is currently played
+type metadataPacket struct {
+	title  string
+	artist string
+	album  string
+	// Length of the track (0 if unknown)
+	duration int64
+}
+
+// repeatTrackPacket repeats a trackPacket of the multicast stream,
+// the format is known even if its datagram is lost
+type repeatTrackPacket struct {
+	// Sequence number of the datagram carrying the trackPacket
+	sequence uint32
+	track    trackPacket
+}
+
+// refusePacket rejects an incompatible client before closing the connection
+type refusePacket struct {
+	// Reason for refusing the client
+	reason string
+}
+
 // preparePacket creates/closes the client's player
 type preparePacket struct {
-	// Sample rate for music playback
-	// > 0 -> Create new player
-	// = 0 -> Close player
-	sampleRate int
+	// Format for music playback
+	// Sample rate > 0 -> Create new player
+	// Sample rate = 0 -> Close player
+	format audio.Format
+	// Codec of the samples on the stream
+	codec Codec
 }
 
 // volumePacket sets the client's volume
 type volumePacket struct {
-	// Volume for the operating system
+	// Volume for the player or the operating system
 	// In range 0 <= volume <= 100
 	volume int
 }
 
+// timeResponsePacket answers a clock synchronization request
+type timeResponsePacket struct {
+	// Client time when sending the request
+	clientTime int64
+	// Server time when receiving the request
+	receiveTime int64
+	// Server time when sending the response
+	sendTime int64
+}
+
+// chunkPacket contains samples for the stream connection
+type chunkPacket struct {
+	// Epoch in which the samples were sent
+	epoch int
+	// Server time at which the first sample is played
+	timestamp int64
+	// Samples in the format of the track
+	samples []byte
+	// Samples encoded with the server's codec (not transmitted)
+	encoded []byte
+	// Track and position of the first sample (not transmitted)
+	source trackPosition
+}
+
+// pausePacket pauses/resumes the client's playback
+type pausePacket struct {
+	// Whether the playback is paused
+	paused bool
+	// New epoch of the playback
+	epoch int
+	// Server time after which samples of older epochs are discarded
+	timestamp int64
+}
+
+// flushPacket discards the client's buffered samples
+type flushPacket struct {
+	// New epoch of the playback
+	epoch int
+	// Server time after which samples of older epochs are discarded
+	timestamp int64
+}
+
+// trackPacket starts a new track on the stream connection
+type trackPacket struct {
+	// Format of the following chunks
+	format audio.Format
+	// Server time at which the previous track ends
+	timestamp int64
+}
+
+// acceptPacket confirms the announcement of a client
+type acceptPacket struct {
+	// Token for attaching the stream connection
+	token []byte
+	// Multicast group of the stream (empty if streamed over TCP)
+	multicastAddr string
+}
+
+// serverInfoPacket answers a discoverPacket
+type serverInfoPacket struct {
+	// Port of the control listener
+	controlPort int
+	// Port of the stream listener
+	streamPort int
+	// Name of the server
+	name string
+}
+
 func newProtocol(conn net.Conn) *protocol {
 	return &protocol{
 		conn:          conn,
-		sendBuffer:    make([]byte, sendBufferSize),
-		receiveBuffer: make([]byte, receiveBufferSize),
+		sendBuffer:    make([]byte, bufferSize),
+		receiveBuffer: make([]byte, bufferSize),
 	}
 }
 
 func (p *protocol) send(packet packet) error {
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+
+	if p.writeClosed {
+		return errWriteClosed
+	}
+
+	size, err := encodePacket(p.sendBuffer, packet)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = p.conn.Write(p.sendBuffer[:size])
+
+	return err
+}
+
+// receive reads the next packet, decoded packets don't share the buffer
+func (p *protocol) receive() (packet, error) {
+	// Header might be split when streaming
+	if _, err := io.ReadFull(p.conn, p.receiveBuffer[:headerSize]); err != nil {
+		return nil, err
+	}
+
+	packet, err := newPacket(p.receiveBuffer[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode size from packet header
+	size := int(p.receiveBuffer[1])<<8 | int(p.receiveBuffer[2])
+
+	if size > maxPacketSize {
+		return nil, errPacketTooLarge
+	}
+
+	if size < packet.size() {
+		return nil, errInvalidPacket
+	}
+
+	// Restore fragmented packets
+	if _, err := io.ReadFull(p.conn, p.receiveBuffer[:size]); err != nil {
+		return nil, err
+	}
+
+	packet.decode(p.receiveBuffer[:size])
+
+	return packet, nil
+}
+
+// closeWrite stops sending packets, the peer is still able to read the sent ones
+func (p *protocol) closeWrite() error {
+	writeCloser, ok := p.conn.(interface{ CloseWrite() error })
+
+	if !ok {
+		return p.conn.Close()
+	}
+
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+
+	p.writeClosed = true
+
+	return writeCloser.CloseWrite()
+}
+
+func (p *protocol) close() error {
+	return p.conn.Close()
+}
+
+// encodePacket writes the header and the packet to the buffer
+func encodePacket(buffer []byte, packet packet) (int, error) {
 	var packetID int
 
 	switch packet.(type) {
+	case *helloPacket:
+		packetID = helloPacketID
+	case *refusePacket:
+		packetID = refusePacketID
 	case *announcePacket:
 		packetID = announcePacketID
 	case *preparePacket:
 		packetID = preparePacketID
 	case *volumePacket:
 		packetID = controlPacketID
+	case *timeRequestPacket:
+		packetID = timeRequestPacketID
+	case *timeResponsePacket:
+		packetID = timeResponsePacketID
+	case *chunkPacket:
+		packetID = chunkPacketID
+	case *pausePacket:
+		packetID = pausePacketID
+	case *flushPacket:
+		packetID = flushPacketID
+	case *trackPacket:
+		packetID = trackPacketID
+	case *acceptPacket:
+		packetID = acceptPacketID
+	case *attachPacket:
+		packetID = attachPacketID
+	case *discoverPacket:
+		packetID = discoverPacketID
+	case *serverInfoPacket:
+		packetID = serverInfoPacketID
+	case *bufferPacket:
+		packetID = bufferPacketID
+	case *pingPacket:
+		packetID = pingPacketID
+	case *pongPacket:
+		packetID = pongPacketID
+	case *goodbyePacket:
+		packetID = goodbyePacketID
+	case *channelMapPacket:
+		packetID = channelMapPacketID
+	case *mutePacket:
+		packetID = mutePacketID
+	case *metadataPacket:
+		packetID = metadataPacketID
+	case *repeatTrackPacket:
+		packetID = repeatTrackPacketID
 	default:
-		return errors.New("unable to transmit packet with unknown id")
+		return 0, errors.New("unable to transmit packet with unknown id")
 	}
 
 	size := packet.size()
 
-	p.sendBuffer[0] = byte(packetID)
-	p.sendBuffer[1] = byte(size >> 8)
-	p.sendBuffer[2] = byte(size)
+	if size > maxPacketSize || headerSize+size > len(buffer) {
+		return 0, errPacketTooLarge
+	}
 
-	packet.encode(p.sendBuffer[3:])
+	buffer[0] = byte(packetID)
+	buffer[1] = byte(size >> 8)
+	buffer[2] = byte(size)
 
-	_, err := p.conn.Write(p.sendBuffer[:3+size])
+	packet.encode(buffer[headerSize:])
 
-	return err
+	return headerSize + size, nil
 }
 
-func (p *protocol) sendRaw(data []byte) (int, error) {
-	return p.conn.Write(data)
-}
+// decodePacket reads a packet including its header from the buffer
+func decodePacket(buffer []byte) (packet, error) {
+	if len(buffer) < headerSize {
+		return nil, errInvalidPacket
+	}
 
-func (p *protocol) receive() (packet, error) {
-	_, err := p.conn.Read(p.receiveBuffer[:3])
+	packet, err := newPacket(buffer[0])
 
 	if err != nil {
 		return nil, err
 	}
 
+	size := int(buffer[1])<<8 | int(buffer[2])
+
+	if size > maxPacketSize {
+		return nil, errPacketTooLarge
+	}
+
+	if size < packet.size() || headerSize+size > len(buffer) {
+		return nil, errInvalidPacket
+	}
+
+	packet.decode(buffer[headerSize : headerSize+size])
+
+	return packet, nil
+}
+
+// newPacket constructs an empty packet for the given ID
+func newPacket(packetID byte) (packet, error) {
 	var packet packet
 
-	switch p.receiveBuffer[0] {
+	switch packetID {
+	case helloPacketID:
+		packet = &helloPacket{}
+	case refusePacketID:
+		packet = &refusePacket{}
 	case announcePacketID:
 		packet = &announcePacket{}
 	case preparePacketID:
 		packet = &preparePacket{}
 	case controlPacketID:
 		packet = &volumePacket{}
+	case timeRequestPacketID:
+		packet = &timeRequestPacket{}
+	case timeResponsePacketID:
+		packet = &timeResponsePacket{}
+	case chunkPacketID:
+		packet = &chunkPacket{}
+	case pausePacketID:
+		packet = &pausePacket{}
+	case flushPacketID:
+		packet = &flushPacket{}
+	case trackPacketID:
+		packet = &trackPacket{}
+	case acceptPacketID:
+		packet = &acceptPacket{}
+	case attachPacketID:
+		packet = &attachPacket{}
+	case discoverPacketID:
+		packet = &discoverPacket{}
+	case serverInfoPacketID:
+		packet = &serverInfoPacket{}
+	case bufferPacketID:
+		packet = &bufferPacket{}
+	case pingPacketID:
+		packet = &pingPacket{}
+	case pongPacketID:
+		packet = &pongPacket{}
+	case goodbyePacketID:
+		packet = &goodbyePacket{}
+	case channelMapPacketID:
+		packet = &channelMapPacket{}
+	case mutePacketID:
+		packet = &mutePacket{}
+	case metadataPacketID:
+		packet = &metadataPacket{}
+	case repeatTrackPacketID:
+		packet = &repeatTrackPacket{}
 	default:
-		return nil, errors.New("received packet with unknown id")
+		return nil, errUnknownPacket
 	}
 
-	// Decode size from packet header
-	size := int(p.receiveBuffer[1])<<8 | int(p.receiveBuffer[2])
+	return packet, nil
+}
 
-	if size < packet.size() {
-		return nil, errors.New("received invalid packet")
+func (p *helloPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint32(buffer[0:], p.magic)
+	binary.BigEndian.PutUint16(buffer[4:], uint16(p.version))
+	binary.BigEndian.PutUint16(buffer[6:], uint16(p.minVersion))
+	buffer[8] = p.codecs
+	buffer[9] = 0
+
+	if p.volumeControl {
+		buffer[9] = 1
 	}
 
-	received := 0
+	offset := 10
+	buffer[offset] = byte(len(p.channels))
+	offset++
 
-	// Restore fragmented packets
-	for received < size {
-		n, err := p.conn.Read(p.receiveBuffer[received:size])
+	for _, channels := range p.channels {
+		buffer[offset] = byte(channels)
+		offset++
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	buffer[offset] = byte(len(p.sampleRates))
+	offset++
 
-		received += n
+	for _, sampleRate := range p.sampleRates {
+		binary.BigEndian.PutUint32(buffer[offset:], uint32(sampleRate))
+		offset += 4
 	}
+}
 
-	packet.decode(p.receiveBuffer[:size])
+func (p *refusePacket) encode(buffer []byte) {
+	copy(buffer, p.reason)
+}
 
-	return packet, nil
+func (p *announcePacket) encode(buffer []byte) {
+	buffer[0] = byte(len(p.id))
+	copy(buffer[1:], p.id)
+	copy(buffer[1+len(p.id):], p.name)
 }
 
-func (p *protocol) receiveRaw() ([]byte, error) {
-	n, err := p.conn.Read(p.receiveBuffer)
+func (p *preparePacket) encode(buffer []byte) {
+	buffer[0] = byte(p.format.SampleRate >> 24)
+	buffer[1] = byte(p.format.SampleRate >> 16)
+	buffer[2] = byte(p.format.SampleRate >> 8)
+	buffer[3] = byte(p.format.SampleRate)
+	buffer[4] = byte(p.codec)
+	encodeFormat(buffer[5:], p.format)
+}
 
-	return p.receiveBuffer[:n], err
+func (p *volumePacket) encode(buffer []byte) {
+	buffer[0] = byte(p.volume)
 }
 
-func (p *protocol) close() error {
-	return p.conn.Close()
+func (p *timeRequestPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint64(buffer, uint64(p.clientTime))
 }
 
-func (p *announcePacket) encode(buffer []byte) {
-	copy(buffer, p.name)
+func (p *timeResponsePacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint64(buffer[0:], uint64(p.clientTime))
+	binary.BigEndian.PutUint64(buffer[8:], uint64(p.receiveTime))
+	binary.BigEndian.PutUint64(buffer[16:], uint64(p.sendTime))
 }
 
-func (p *preparePacket) encode(buffer []byte) {
-	buffer[0] = byte(p.sampleRate >> 8)
-	buffer[1] = byte(p.sampleRate)
+func (p *chunkPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint32(buffer[0:], uint32(p.epoch))
+	binary.BigEndian.PutUint64(buffer[4:], uint64(p.timestamp))
+	copy(buffer[12:], p.samples)
 }
 
-func (p *volumePacket) encode(buffer []byte) {
-	buffer[0] = byte(p.volume)
+func (p *pausePacket) encode(buffer []byte) {
+	buffer[0] = 0
+
+	if p.paused {
+		buffer[0] = 1
+	}
+
+	binary.BigEndian.PutUint32(buffer[1:], uint32(p.epoch))
+	binary.BigEndian.PutUint64(buffer[5:], uint64(p.timestamp))
+}
+
+func (p *flushPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint32(buffer[0:], uint32(p.epoch))
+	binary.BigEndian.PutUint64(buffer[4:], uint64(p.timestamp))
+}
+
+func (p *trackPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint32(buffer[0:], uint32(p.format.SampleRate))
+	binary.BigEndian.PutUint64(buffer[4:], uint64(p.timestamp))
+	encodeFormat(buffer[12:], p.format)
+}
+
+func (p *acceptPacket) encode(buffer []byte) {
+	copy(buffer, p.token)
+	copy(buffer[tokenSize:], p.multicastAddr)
+}
+
+func (p *attachPacket) encode(buffer []byte) {
+	copy(buffer, p.token)
+}
+
+func (p *discoverPacket) encode(buffer []byte) {
+}
+
+func (p *serverInfoPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint16(buffer[0:], uint16(p.controlPort))
+	binary.BigEndian.PutUint16(buffer[2:], uint16(p.streamPort))
+	copy(buffer[4:], p.name)
+}
+
+func (p *bufferPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint64(buffer[0:], uint64(p.target))
+	binary.BigEndian.PutUint64(buffer[8:], uint64(p.fill))
+	binary.BigEndian.PutUint32(buffer[16:], uint32(p.underruns))
+}
+
+func (p *pingPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint64(buffer[0:], uint64(p.sendTime))
+}
+
+func (p *pongPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint64(buffer[0:], uint64(p.sendTime))
+}
+
+func (p *goodbyePacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint64(buffer[0:], uint64(p.reconnectDelay))
+	copy(buffer[8:], p.reason)
+}
+
+func (p *channelMapPacket) encode(buffer []byte) {
+	buffer[0] = byte(p.mapping)
+}
+
+func (p *mutePacket) encode(buffer []byte) {
+	buffer[0] = 0
+
+	if p.muted {
+		buffer[0] = 1
+	}
+}
+
+func (p *metadataPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint64(buffer[0:], uint64(p.duration))
+	offset := 8
+
+	for _, str := range []string{p.title, p.artist, p.album} {
+		buffer[offset] = byte(len(str))
+		copy(buffer[offset+1:], str)
+		offset += 1 + len(str)
+	}
+}
+
+func (p *repeatTrackPacket) encode(buffer []byte) {
+	binary.BigEndian.PutUint32(buffer[0:], p.sequence)
+	p.track.encode(buffer[4:])
+}
+
+// encodeFormat appends the channels and bit depth to the sample rate
+func encodeFormat(buffer []byte, format audio.Format) {
+	buffer[0] = byte(format.Channels)
+	buffer[1] = byte(format.BitDepth)
+}
+
+func (p *helloPacket) decode(buffer []byte) {
+	p.magic = binary.BigEndian.Uint32(buffer[0:])
+	p.version = int(binary.BigEndian.Uint16(buffer[4:]))
+	p.minVersion = int(binary.BigEndian.Uint16(buffer[6:]))
+	p.codecs = buffer[8]
+	p.volumeControl = buffer[9] == 1
+
+	// Lists are truncated if the counts exceed the packet
+	offset := 10
+	count := int(buffer[offset])
+	offset++
+	p.channels = make([]int, 0, count)
+
+	for i := 0; i < count && offset < len(buffer); i++ {
+		p.channels = append(p.channels, int(buffer[offset]))
+		offset++
+	}
+
+	count = 0
+
+	if offset < len(buffer) {
+		count = int(buffer[offset])
+		offset++
+	}
+
+	p.sampleRates = make([]int, 0, count)
+
+	for i := 0; i < count && offset+4 <= len(buffer); i++ {
+		p.sampleRates = append(p.sampleRates, int(binary.BigEndian.Uint32(buffer[offset:])))
+		offset += 4
+	}
+}
+
+func (p *refusePacket) decode(buffer []byte) {
+	p.reason = string(buffer)
 }
 
 func (p *announcePacket) decode(buffer []byte) {
-	p.name = string(buffer)
+	idLength := int(buffer[0])
+
+	if idLength > len(buffer)-1 {
+		idLength = len(buffer) - 1
+	}
+
+	p.id = string(buffer[1 : 1+idLength])
+	p.name = string(buffer[1+idLength:])
 }
 
 func (p *preparePacket) decode(buffer []byte) {
-	p.sampleRate = int(buffer[0])<<8 | int(buffer[1])
+	sampleRate := int(buffer[0])<<24 | int(buffer[1])<<16 |
+		int(buffer[2])<<8 | int(buffer[3])
+	p.codec = Codec(buffer[4])
+	p.format = decodeFormat(buffer[5:], sampleRate)
 }
 
 func (p *volumePacket) decode(buffer []byte) {
 	p.volume = int(buffer[0])
 }
 
+func (p *timeRequestPacket) decode(buffer []byte) {
+	p.clientTime = int64(binary.BigEndian.Uint64(buffer))
+}
+
+func (p *timeResponsePacket) decode(buffer []byte) {
+	p.clientTime = int64(binary.BigEndian.Uint64(buffer[0:]))
+	p.receiveTime = int64(binary.BigEndian.Uint64(buffer[8:]))
+	p.sendTime = int64(binary.BigEndian.Uint64(buffer[16:]))
+}
+
+func (p *chunkPacket) decode(buffer []byte) {
+	p.epoch = int(binary.BigEndian.Uint32(buffer[0:]))
+	p.timestamp = int64(binary.BigEndian.Uint64(buffer[4:]))
+
+	// Receive buffer is reused for the next packet
+	p.samples = make([]byte, len(buffer)-12)
+	copy(p.samples, buffer[12:])
+}
+
+func (p *pausePacket) decode(buffer []byte) {
+	p.paused = buffer[0] == 1
+	p.epoch = int(binary.BigEndian.Uint32(buffer[1:]))
+	p.timestamp = int64(binary.BigEndian.Uint64(buffer[5:]))
+}
+
+func (p *flushPacket) decode(buffer []byte) {
+	p.epoch = int(binary.BigEndian.Uint32(buffer[0:]))
+	p.timestamp = int64(binary.BigEndian.Uint64(buffer[4:]))
+}
+
+func (p *trackPacket) decode(buffer []byte) {
+	sampleRate := int(binary.BigEndian.Uint32(buffer[0:]))
+	p.timestamp = int64(binary.BigEndian.Uint64(buffer[4:]))
+	p.format = decodeFormat(buffer[12:], sampleRate)
+}
+
+func (p *acceptPacket) decode(buffer []byte) {
+	p.token = make([]byte, tokenSize)
+	copy(p.token, buffer)
+	p.multicastAddr = string(buffer[tokenSize:])
+}
+
+func (p *attachPacket) decode(buffer []byte) {
+	p.token = make([]byte, tokenSize)
+	copy(p.token, buffer)
+}
+
+func (p *discoverPacket) decode(buffer []byte) {
+}
+
+func (p *serverInfoPacket) decode(buffer []byte) {
+	p.controlPort = int(binary.BigEndian.Uint16(buffer[0:]))
+	p.streamPort = int(binary.BigEndian.Uint16(buffer[2:]))
+	p.name = string(buffer[4:])
+}
+
+func (p *bufferPacket) decode(buffer []byte) {
+	p.target = int64(binary.BigEndian.Uint64(buffer[0:]))
+	p.fill = int64(binary.BigEndian.Uint64(buffer[8:]))
+	p.underruns = int(binary.BigEndian.Uint32(buffer[16:]))
+}
+
+func (p *pingPacket) decode(buffer []byte) {
+	p.sendTime = int64(binary.BigEndian.Uint64(buffer[0:]))
+}
+
+func (p *pongPacket) decode(buffer []byte) {
+	p.sendTime = int64(binary.BigEndian.Uint64(buffer[0:]))
+}
+
+func (p *goodbyePacket) decode(buffer []byte) {
+	p.reconnectDelay = int64(binary.BigEndian.Uint64(buffer[0:]))
+	p.reason = string(buffer[8:])
+}
+
+func (p *channelMapPacket) decode(buffer []byte) {
+	p.mapping = audio.ChannelMap(buffer[0])
+}
+
+func (p *mutePacket) decode(buffer []byte) {
+	p.muted = buffer[0] == 1
+}
+
+func (p *metadataPacket) decode(buffer []byte) {
+	p.duration = int64(binary.BigEndian.Uint64(buffer[0:]))
+	buffer = buffer[8:]
+
+	for _, str := range []*string{&p.title, &p.artist, &p.album} {
+		if len(buffer) == 0 {
+			return
+		}
+
+		length := int(buffer[0])
+
+		if length > len(buffer)-1 {
+			length = len(buffer) - 1
+		}
+
+		*str = string(buffer[1 : 1+length])
+		buffer = buffer[1+length:]
+	}
+}
+
+func (p *repeatTrackPacket) decode(buffer []byte) {
+	p.sequence = binary.BigEndian.Uint32(buffer[0:])
+	p.track.decode(buffer[4:])
+}
+
+// decodeFormat reads the channels and bit depth following the sample rate
+func decodeFormat(buffer []byte, sampleRate int) audio.Format {
+	return audio.Format{
+		SampleRate: sampleRate,
+		Channels:   int(buffer[0]),
+		BitDepth:   int(buffer[1]),
+	}
+}
+
+func (p *helloPacket) size() int {
+	return 12 + len(p.channels) + 4*len(p.sampleRates)
+}
+
+func (p *refusePacket) size() int {
+	return len(p.reason)
+}
+
 func (p *announcePacket) size() int {
-	return len(p.name)
+	return 1 + len(p.id) + len(p.name)
 }
 
 func (p *preparePacket) size() int {
-	return 2
+	return 7
 }
 
 func (p *volumePacket) size() int {
 	return 1
 }
+
+func (p *timeRequestPacket) size() int {
+	return 8
+}
+
+func (p *timeResponsePacket) size() int {
+	return 24
+}
+
+func (p *chunkPacket) size() int {
+	return 12 + len(p.samples)
+}
+
+func (p *pausePacket) size() int {
+	return 13
+}
+
+func (p *flushPacket) size() int {
+	return 12
+}
+
+func (p *trackPacket) size() int {
+	return 14
+}
+
+func (p *acceptPacket) size() int {
+	return tokenSize + len(p.multicastAddr)
+}
+
+func (p *attachPacket) size() int {
+	return tokenSize
+}
+
+func (p *discoverPacket) size() int {
+	return 0
+}
+
+func (p *serverInfoPacket) size() int {
+	return 4 + len(p.name)
+}
+
+func (p *bufferPacket) size() int {
+	return 20
+}
+
+func (p *pingPacket) size() int {
+	return 8
+}
+
+func (p *pongPacket) size() int {
+	return 8
+}
+
+func (p *goodbyePacket) size() int {
+	return 8 + len(p.reason)
+}
+
+func (p *channelMapPacket) size() int {
+	return 1
+}
+
+func (p *mutePacket) size() int {
+	return 1
+}
+
+func (p *metadataPacket) size() int {
+	return 8 + 3 + len(p.title) + len(p.artist) + len(p.album)
+}
+
+func (p *repeatTrackPacket) size() int {
+	return 4 + p.track.size()
+}
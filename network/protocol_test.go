@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/medusalix/multispeaker/audio"
+)
+
+// One packet of each type with all transmitted fields set
+var testPackets = []struct {
+	name   string
+	packet packet
+}{
+	{"hello", &helloPacket{
+		magic:         protocolMagic,
+		version:       protocolVersion,
+		minVersion:    minProtocolVersion,
+		sampleRates:   []int{44100, 48000},
+		channels:      []int{1, 2, 6},
+		codecs:        codecMask(supportedCodecs),
+		volumeControl: true,
+	}},
+	{"refuse", &refusePacket{reason: "outdated"}},
+	{"announce", &announcePacket{id: "0123456789abcdef", name: "speaker"}},
+	{"prepare", &preparePacket{
+		format: audio.Format{SampleRate: 48000, Channels: 6, BitDepth: audio.BitDepth},
+		codec:  CodecLossless,
+	}},
+	{"volume", &volumePacket{volume: 75}},
+	{"timeRequest", &timeRequestPacket{clientTime: 1234567890}},
+	{"timeResponse", &timeResponsePacket{clientTime: 1, receiveTime: 2, sendTime: 3}},
+	{"chunk", &chunkPacket{epoch: 2, timestamp: 987654321, samples: []byte{1, 2, 3, 4}}},
+	{"pause", &pausePacket{paused: true, epoch: 3, timestamp: 42}},
+	{"flush", &flushPacket{epoch: 4, timestamp: 43}},
+	{"track", &trackPacket{
+		format:    audio.Format{SampleRate: 44100, Channels: 1, BitDepth: audio.BitDepth},
+		timestamp: 44,
+	}},
+	{"accept", &acceptPacket{
+		token:         []byte("0123456789abcdef"),
+		multicastAddr: "239.255.77.77:12347",
+	}},
+	{"attach", &attachPacket{token: []byte("fedcba9876543210")}},
+	{"discover", &discoverPacket{}},
+	{"serverInfo", &serverInfoPacket{controlPort: 12345, streamPort: 12346, name: "server"}},
+	{"buffer", &bufferPacket{target: 200, fill: 150, underruns: 1}},
+	{"ping", &pingPacket{sendTime: 45}},
+	{"pong", &pongPacket{sendTime: 46}},
+	{"goodbye", &goodbyePacket{reconnectDelay: 5000, reason: "server is shutting down"}},
+	{"channelMap", &channelMapPacket{mapping: audio.MapLeft}},
+	{"mute", &mutePacket{muted: true}},
+	{"metadata", &metadataPacket{title: "Title", artist: "Artist", album: "Album", duration: 180}},
+	{"repeatTrack", &repeatTrackPacket{
+		sequence: 7,
+		track: trackPacket{
+			format:    audio.Format{SampleRate: 96000, Channels: 2, BitDepth: audio.BitDepth},
+			timestamp: 47,
+		},
+	}},
+}
+
+// roundTrip encodes the packet and decodes it again
+func roundTrip(t *testing.T, packet packet) packet {
+	buffer := make([]byte, bufferSize)
+	size, err := encodePacket(buffer, packet)
+
+	if err != nil {
+		t.Fatal("Unable to encode packet: ", err)
+	}
+
+	decoded, err := decodePacket(buffer[:size])
+
+	if err != nil {
+		t.Fatal("Unable to decode packet: ", err)
+	}
+
+	return decoded
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	for _, test := range testPackets {
+		t.Run(test.name, func(t *testing.T) {
+			decoded := roundTrip(t, test.packet)
+
+			if !reflect.DeepEqual(decoded, test.packet) {
+				t.Errorf("Decoded %+v, expected %+v", decoded, test.packet)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidPacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer []byte
+		err    error
+	}{
+		{"empty", nil, errInvalidPacket},
+		{"short header", []byte{chunkPacketID, 0}, errInvalidPacket},
+		{"unknown id", []byte{255, 0, 0}, errUnknownPacket},
+		{"too large", []byte{chunkPacketID, 0xff, 0xff}, errPacketTooLarge},
+		{"below minimum size", []byte{pausePacketID, 0, 1, 1}, errInvalidPacket},
+		{"truncated", []byte{controlPacketID, 0, 2, 1}, errInvalidPacket},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodePacket(test.buffer); err != test.err {
+				t.Errorf("Got error %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+// Decoded packets are encoded again, so every accepted packet survives a round trip
+func FuzzDecodePacket(f *testing.F) {
+	buffer := make([]byte, bufferSize)
+
+	for _, test := range testPackets {
+		size, err := encodePacket(buffer, test.packet)
+
+		if err != nil {
+			f.Fatal("Unable to encode packet: ", err)
+		}
+
+		f.Add(append([]byte(nil), buffer[:size]...))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, err := decodePacket(data)
+
+		if err != nil {
+			return
+		}
+
+		if again := roundTrip(t, decoded); !reflect.DeepEqual(again, decoded) {
+			t.Errorf("Decoded %+v after encoding %+v", again, decoded)
+		}
+	})
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/medusalix/multispeaker/audio"
+)
+
+// RepeatMode specifies what happens at the end of a track
+type RepeatMode int
+
+const (
+	// RepeatOff stops after the last track
+	RepeatOff RepeatMode = iota
+	// RepeatOne plays the current track again
+	RepeatOne
+	// RepeatAll starts over after the last track
+	RepeatAll
+)
+
+var repeatModeNames = []string{"off", "one", "all"}
+
+// ParseRepeatMode returns the repeat mode with the given name
+func ParseRepeatMode(name string) (RepeatMode, error) {
+	for i, modeName := range repeatModeNames {
+		if strings.EqualFold(name, modeName) {
+			return RepeatMode(i), nil
+		}
+	}
+
+	return RepeatOff, fmt.Errorf("unknown repeat mode '%s'", name)
+}
+
+func (m RepeatMode) String() string {
+	return repeatModeNames[m]
+}
+
+// queue holds the tracks that are played one after another
+type queue struct {
+	mutex   sync.Mutex
+	tracks  []string
+	current int
+	repeat  RepeatMode
+	random  *rand.Rand
+}
+
+func newQueue() *queue {
+	return &queue{
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// PathError is returned if a path can't be added to the queue
+type PathError struct {
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// add appends a file or all audio files of a directory
+func (q *queue) add(path string) (int, error) {
+	tracks, err := resolveTracks(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	q.mutex.Lock()
+	q.tracks = append(q.tracks, tracks...)
+	q.mutex.Unlock()
+
+	return len(tracks), nil
+}
+
+// resolveTracks returns a file or all audio files of a directory
+func resolveTracks(path string) ([]string, error) {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return nil, &PathError{path, err}
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	tracks, err := findTracks(path)
+
+	if err != nil {
+		return nil, &PathError{path, err}
+	}
+
+	if len(tracks) == 0 {
+		return nil, &PathError{path, errors.New("directory contains no audio files")}
+	}
+
+	return tracks, nil
+}
+
+// findTracks returns the sorted audio files of a directory and its subdirectories
+func findTracks(dir string) ([]string, error) {
+	tracks := make([]string, 0)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && audio.HasAudioExtension(path) {
+			tracks = append(tracks, path)
+		}
+
+		return nil
+	})
+
+	sort.Strings(tracks)
+
+	return tracks, err
+}
+
+// clear removes all tracks, keepCurrent retains the current one
+func (q *queue) clear(keepCurrent bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if keepCurrent && q.current < len(q.tracks) {
+		q.tracks = []string{q.tracks[q.current]}
+	} else {
+		q.tracks = nil
+	}
+
+	q.current = 0
+}
+
+// replace exchanges the tracks and the current index, the previous ones are returned
+func (q *queue) replace(tracks []string, current int) ([]string, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	previous, previousCurrent := q.tracks, q.current
+	q.tracks = tracks
+	q.current = current
+
+	return previous, previousCurrent
+}
+
+// list returns the tracks and the index of the current one
+func (q *queue) list() ([]string, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	tracks := make([]string, len(q.tracks))
+	copy(tracks, q.tracks)
+
+	return tracks, q.current
+}
+
+// track returns the current track
+func (q *queue) track() (string, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.current >= len(q.tracks) {
+		return "", false
+	}
+
+	return q.tracks[q.current], true
+}
+
+// advance moves to the following track, skip ignores repeating a single track
+func (q *queue) advance(skip bool) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.tracks) == 0 {
+		return false
+	}
+
+	if q.repeat == RepeatOne && !skip {
+		return true
+	}
+
+	if q.current+1 < len(q.tracks) {
+		q.current++
+
+		return true
+	}
+
+	if q.repeat == RepeatAll {
+		q.current = 0
+
+		return true
+	}
+
+	return false
+}
+
+// rewind moves back to the first track
+func (q *queue) rewind() {
+	q.mutex.Lock()
+	q.current = 0
+	q.mutex.Unlock()
+}
+
+// back moves to the previous track
+func (q *queue) back() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.current > 0 {
+		q.current--
+
+		return true
+	}
+
+	if q.repeat == RepeatAll && len(q.tracks) > 0 {
+		q.current = len(q.tracks) - 1
+
+		return true
+	}
+
+	return false
+}
+
+// shuffle randomizes the order of the upcoming tracks
+func (q *queue) shuffle() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.current+1 >= len(q.tracks) {
+		return
+	}
+
+	upcoming := q.tracks[q.current+1:]
+
+	q.random.Shuffle(len(upcoming), func(i, j int) {
+		upcoming[i], upcoming[j] = upcoming[j], upcoming[i]
+	})
+}
+
+// move changes the position of a track
+func (q *queue) move(from int, to int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if from < 0 || from >= len(q.tracks) || to < 0 || to >= len(q.tracks) {
+		return errors.New("track index out of range")
+	}
+
+	track := q.tracks[from]
+	q.tracks = append(q.tracks[:from], q.tracks[from+1:]...)
+	q.tracks = append(q.tracks[:to], append([]string{track}, q.tracks[to:]...)...)
+
+	// Keep the current track selected
+	switch {
+	case q.current == from:
+		q.current = to
+	case from < q.current && to >= q.current:
+		q.current--
+	case from > q.current && to <= q.current:
+		q.current++
+	}
+
+	return nil
+}
+
+// remove removes a track, the current track can't be removed
+func (q *queue) remove(index int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if index < 0 || index >= len(q.tracks) {
+		return errors.New("track index out of range")
+	}
+
+	if index == q.current {
+		return errors.New("track is currently selected")
+	}
+
+	q.tracks = append(q.tracks[:index], q.tracks[index+1:]...)
+
+	if index < q.current {
+		q.current--
+	}
+
+	return nil
+}
+
+func (q *queue) setRepeat(mode RepeatMode) {
+	q.mutex.Lock()
+	q.repeat = mode
+	q.mutex.Unlock()
+}
+
+func (q *queue) repeatMode() RepeatMode {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.repeat
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Time for establishing a secure connection
+const authTimeout = time.Second * 5
+
+// Label for deriving the pre-shared key proofs from the TLS session
+const pskExporterLabel = "EXPORTER-multispeaker-psk"
+
+// Roles included in the pre-shared key proofs
+const (
+	pskClientRole = 'c'
+	pskServerRole = 's'
+)
+
+var errInvalidProof = errors.New("invalid pre-shared key proof")
+
+// SecurityConfig specifies how connections are encrypted and authenticated
+type SecurityConfig struct {
+	// Certificate and private key presented to the peer (PEM files)
+	CertFile string
+	KeyFile  string
+	// Certificate authority the peer's certificate is verified with
+	// Server: clients need a certificate signed by it
+	// Client: replaces the system's certificate authorities
+	CAFile string
+	// Secret shared by the server and all clients
+	PSK string
+	// Name the server's certificate is verified with (client only)
+	ServerName string
+}
+
+// security wraps connections in TLS and checks the pre-shared key
+type security struct {
+	tlsConfig *tls.Config
+	psk       []byte
+}
+
+func newServerSecurity(config *SecurityConfig) (*security, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if config.PSK != "" {
+		// Clients authenticate the server through the pre-shared key
+		cert, err := generateCertificate()
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else {
+		return nil, errors.New("certificate or pre-shared key required")
+	}
+
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return &security{
+		tlsConfig: tlsConfig,
+		psk:       []byte(config.PSK),
+	}, nil
+}
+
+func newClientSecurity(config *SecurityConfig) (*security, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.ServerName,
+	}
+
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = pool
+	} else if config.PSK != "" {
+		// Server's certificate is generated, the pre-shared key proves its identity
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return &security{
+		tlsConfig: tlsConfig,
+		psk:       []byte(config.PSK),
+	}, nil
+}
+
+// loadCertPool reads the certificates of a PEM file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in '%s'", path)
+	}
+
+	return pool, nil
+}
+
+// generateCertificate creates a self-signed certificate for the server
+func generateCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "multispeaker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{cert},
+		PrivateKey:  key,
+	}, nil
+}
+
+// server performs the handshake for an accepted connection
+func (s *security) server(conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Server(conn, s.tlsConfig)
+
+	tlsConn.SetDeadline(time.Now().Add(authTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	if len(s.psk) == 0 {
+		return tlsConn, nil
+	}
+
+	// Client proves its key first, the server's proof isn't revealed otherwise
+	if err := s.checkProof(tlsConn, pskClientRole); err != nil {
+		if err == errInvalidProof {
+			return nil, errors.New("client has a different pre-shared key")
+		}
+
+		return nil, err
+	}
+
+	if err := s.sendProof(tlsConn, pskServerRole); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// client performs the handshake for a dialed connection
+func (s *security) client(conn net.Conn) (net.Conn, error) {
+	tlsConfig := s.tlsConfig
+
+	// Discovered servers are verified using their address
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+
+	tlsConn.SetDeadline(time.Now().Add(authTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	if len(s.psk) == 0 {
+		return tlsConn, nil
+	}
+
+	if err := s.sendProof(tlsConn, pskClientRole); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkProof(tlsConn, pskServerRole); err != nil {
+		if err == errInvalidProof {
+			return nil, errors.New("server has a different pre-shared key")
+		}
+
+		return nil, errors.New("server rejected the pre-shared key")
+	}
+
+	return tlsConn, nil
+}
+
+func (s *security) sendProof(conn *tls.Conn, role byte) error {
+	proof, err := s.proof(conn, role)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(proof)
+
+	return err
+}
+
+func (s *security) checkProof(conn *tls.Conn, role byte) error {
+	expected, err := s.proof(conn, role)
+
+	if err != nil {
+		return err
+	}
+
+	received := make([]byte, len(expected))
+
+	if _, err := io.ReadFull(conn, received); err != nil {
+		return err
+	}
+
+	if !hmac.Equal(received, expected) {
+		return errInvalidProof
+	}
+
+	return nil
+}
+
+// proof binds the pre-shared key to the TLS session,
+// preventing it from being relayed to another connection
+func (s *security) proof(conn *tls.Conn, role byte) ([]byte, error) {
+	state := conn.ConnectionState()
+	material, err := state.ExportKeyingMaterial(pskExporterLabel, nil, sha256.Size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, s.psk)
+	mac.Write(material)
+	mac.Write([]byte{role})
+
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/medusalix/multispeaker/log"
+)
+
+// Number of packets waiting to be sent to an endpoint
+const senderQueueSize = 256
+
+// SlowClientPolicy specifies what happens when a client can't keep up with the stream
+type SlowClientPolicy int
+
+const (
+	// PolicyDrop discards samples the client can't receive in time
+	PolicyDrop SlowClientPolicy = iota
+	// PolicyDisconnect disconnects the client, it joins again after reconnecting
+	PolicyDisconnect
+	// PolicyLag waits for the client, delaying the stream for all clients
+	PolicyLag
+)
+
+var slowClientPolicyNames = []string{"drop", "disconnect", "lag"}
+
+var (
+	errStreamClosed  = errors.New("stream is closed")
+	errClientTooSlow = errors.New("client is too slow")
+)
+
+// ParseSlowClientPolicy returns the policy with the given name
+func ParseSlowClientPolicy(name string) (SlowClientPolicy, error) {
+	for i, policyName := range slowClientPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return SlowClientPolicy(i), nil
+		}
+	}
+
+	return PolicyDrop, fmt.Errorf("unknown policy '%s'", name)
+}
+
+func (p SlowClientPolicy) String() string {
+	return slowClientPolicyNames[p]
+}
+
+// streamSender sends packets to an endpoint without blocking the stream
+type streamSender struct {
+	name      string
+	stream    *protocol
+	policy    SlowClientPolicy
+	packets   chan packet
+	done      chan bool
+	closeOnce sync.Once
+	dropping  bool
+}
+
+func newStreamSender(name string, stream *protocol, policy SlowClientPolicy) *streamSender {
+	sender := &streamSender{
+		name:    name,
+		stream:  stream,
+		policy:  policy,
+		packets: make(chan packet, senderQueueSize),
+		done:    make(chan bool),
+	}
+
+	go sender.run()
+
+	return sender
+}
+
+func (s *streamSender) run() {
+	for {
+		select {
+		case packet := <-s.packets:
+			if err := s.stream.send(packet); err != nil {
+				log.Debugf("Unable to stream samples to '%s': %s", s.name, err)
+				s.close()
+
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// queue adds a packet to the queue, wait ignores the policy if the queue is full
+func (s *streamSender) queue(packet packet, wait bool) error {
+	select {
+	case <-s.done:
+		return errStreamClosed
+	default:
+	}
+
+	_, isChunk := packet.(*chunkPacket)
+
+	// Track changes can't be dropped
+	if wait || s.policy == PolicyLag || !isChunk && s.policy == PolicyDrop {
+		select {
+		case s.packets <- packet:
+			return nil
+		case <-s.done:
+			return errStreamClosed
+		}
+	}
+
+	select {
+	case s.packets <- packet:
+		if s.dropping {
+			log.Infof("Client '%s' has caught up", s.name)
+			s.dropping = false
+		}
+
+		return nil
+	default:
+	}
+
+	if s.policy == PolicyDisconnect {
+		return errClientTooSlow
+	}
+
+	if !s.dropping {
+		log.Infof("Client '%s' is too slow, dropping samples", s.name)
+		s.dropping = true
+	}
+
+	return nil
+}
+
+// closed checks if the stream was closed or has failed
+func (s *streamSender) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *streamSender) close() error {
+	var err error
+
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.stream.close()
+	})
+
+	return err
+}
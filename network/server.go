@@ -17,9 +17,13 @@
 package network
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -29,28 +33,159 @@ import (
 
 const streamReadyTimeout = time.Second * 5
 
+// Time for a new stream connection to send its token
+const streamAttachTimeout = time.Second * 5
+
+// DefaultLeadWindow is the time samples are streamed ahead of their playback
+// until the clients report their buffer targets
+const DefaultLeadWindow = time.Millisecond * 500
+
+const (
+	// Shortest lead window, covers the network and the clients' player buffer
+	minLeadWindow = time.Millisecond * 100
+	// Longest lead window, the clients can't buffer more samples
+	maxLeadWindow = time.Second * 2
+)
+
+// Time until a pause takes effect, covers the clients' player buffer
+const pauseDelay = time.Millisecond * 200
+
+// Time for clients to receive the first samples after flushing their buffers,
+// covers the network and the clients' player buffer
+const flushDelay = time.Millisecond * 150
+
+// Time for clients to recreate their player when the sample rate changes
+const trackChangeDelay = time.Millisecond * 300
+
+// Time clients are asked to wait before reconnecting after a shutdown
+const shutdownReconnectDelay = time.Second * 5
+
+// Measured loudness of the tracks, relative to the user's cache directory
+const loudnessCacheFile = "multispeaker/loudness.json"
+
+var errServerShutDown = errors.New("server was shut down")
+
+var errMusicStopped = errors.New("music was stopped")
+
+var (
+	// ErrAlreadyPlaying is returned when starting the playback while music is playing
+	ErrAlreadyPlaying = errors.New("music is already playing")
+	// ErrNotPlaying is returned when controlling the playback while no music is playing
+	ErrNotPlaying = errors.New("music is currently not playing")
+	// ErrNoPlayableTrack is returned if none of the tracks in the queue can be loaded
+	ErrNoPlayableTrack = errors.New("no playable track in queue")
+)
+
+// Status describes the state of the music playback
+type Status struct {
+	// Whether music is currently streamed
+	Playing bool
+	// Whether the playback is paused
+	Paused bool
+	// Path of the current track
+	Track string
+	// Title, artist and album of the current track
+	Metadata audio.Metadata
+	// Position of the currently played sample
+	Position time.Duration
+	// Length of the current track (0 if unknown)
+	Length time.Duration
+	// What happens at the end of a track
+	Repeat RepeatMode
+}
+
+// streamedTrack is a track whose samples are streamed
+type streamedTrack struct {
+	path     string
+	format   audio.Format
+	length   time.Duration
+	metadata audio.Metadata
+}
+
+// trackPosition locates samples within their track
+type trackPosition struct {
+	track  *streamedTrack
+	offset time.Duration
+}
+
+// unplayedSamples are samples that need to be streamed again
+type unplayedSamples struct {
+	samples []byte
+	source  trackPosition
+}
+
+// advance returns the position after the given duration
+func (p trackPosition) advance(duration int64) trackPosition {
+	p.offset += time.Duration(duration)
+
+	return p
+}
+
 // Server is used to accept new clients and stream music
 type Server struct {
-	controlAddr     *net.TCPAddr
-	streamAddr      *net.TCPAddr
-	controlListener net.Listener
-	streamListener  net.Listener
-	endpoints       map[string]*endpoint
-	mutex           sync.RWMutex
-	music           *audio.Music
-	streamReady     chan bool
-	streaming       bool
+	controlAddr      *net.TCPAddr
+	streamAddr       *net.TCPAddr
+	controlListener  net.Listener
+	streamListener   net.Listener
+	multicastAddr    *net.UDPAddr
+	multicast        *multicastSender
+	codec            Codec
+	security         *security
+	discoveryName    string
+	discovery        *net.UDPConn
+	slowClientPolicy SlowClientPolicy
+	leadWindow       time.Duration
+	heartbeatTimeout time.Duration
+	endpoints        map[string]*endpoint
+	connections      map[*endpoint]bool
+	channelMaps      map[string]audio.ChannelMap
+	volumes          map[string]int
+	mutes            map[string]bool
+	mutex            sync.RWMutex
+	goroutines       sync.WaitGroup
+	shutDown         bool
+	music            *audio.Music
+	scanner          *audio.LoudnessScanner
+	queue            *queue
+	streamReady      chan bool
+	playbackMutex    sync.Mutex
+	playbackCond     *sync.Cond
+	streaming        bool
+	paused           bool
+	epoch            int
+	format           audio.Format
+	track            *streamedTrack
+	startTime        int64
+	position         int64
+	sentChunks       []*chunkPacket
+	unplayed         []*unplayedSamples
+	pendingTrack     *trackPacket
+	queueEnded       bool
+	// Playback is claimed while its first track is loaded and prepared
+	starting bool
+	// Increased for each playback, streams of previous ones stop
+	generation int
 }
 
 // NewServer constructs a new server
 func NewServer(controlAddr *net.TCPAddr, streamAddr *net.TCPAddr) *Server {
-	return &Server{
-		controlAddr: controlAddr,
-		streamAddr:  streamAddr,
-		endpoints:   make(map[string]*endpoint),
-		music:       audio.NewMusic(),
-		streamReady: make(chan bool),
+	server := &Server{
+		controlAddr:      controlAddr,
+		streamAddr:       streamAddr,
+		leadWindow:       DefaultLeadWindow,
+		heartbeatTimeout: DefaultHeartbeatTimeout,
+		endpoints:        make(map[string]*endpoint),
+		connections:      make(map[*endpoint]bool),
+		channelMaps:      make(map[string]audio.ChannelMap),
+		volumes:          make(map[string]int),
+		mutes:            make(map[string]bool),
+		music:            audio.NewMusic(),
+		queue:            newQueue(),
+		streamReady:      make(chan bool, 1),
 	}
+	server.playbackCond = sync.NewCond(&server.playbackMutex)
+
+	return server
 }
 
 // Start starts the server
@@ -68,229 +203,1669 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	if s.multicastAddr != nil {
+		s.multicast, err = newMulticastSender(s.multicastAddr)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.discoveryName != "" {
+		s.startDiscovery()
+	}
+
+	s.goroutines.Add(2)
+
 	go s.listenControl()
 	go s.listenStream()
 
 	return nil
 }
 
-// GetConnectedUsers returns a list of the currently connected users
-func (s *Server) GetConnectedUsers() []string {
+// Shutdown stops the playback, says goodbye to the clients and closes all connections,
+// waits until the connections have been handled or the context is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+
+	if s.shutDown {
+		s.mutex.Unlock()
+
+		return errServerShutDown
+	}
+
+	s.shutDown = true
+	s.mutex.Unlock()
+
+	log.Info("Shutting down server")
+
+	s.controlListener.Close()
+	s.streamListener.Close()
+
+	if s.discovery != nil {
+		s.discovery.Close()
+	}
+
+	if err := s.StopMusic(); err != nil && err != ErrNotPlaying {
+		log.Error("Error stopping music playback: ", err)
+	}
+
+	if s.multicast != nil {
+		s.multicast.close()
+	}
+
+	if s.scanner != nil {
+		s.scanner.Close()
+	}
+
 	s.mutex.RLock()
-	defer s.mutex.RUnlock()
 
-	users := make([]string, 0, len(s.endpoints))
+	for endpoint := range s.connections {
+		// Client didn't announce itself yet
+		if s.endpoints[endpoint.id] != endpoint {
+			endpoint.close()
 
-	for _, endpoint := range s.endpoints {
-		users = append(users, endpoint.name)
+			continue
+		}
+
+		if err := endpoint.goodbye("server is shutting down", shutdownReconnectDelay); err != nil {
+			log.Debugf("Unable to say goodbye to '%s': %s", endpoint.name, err)
+		}
 	}
 
-	return users
-}
+	s.mutex.RUnlock()
 
-// PlayMusic initiates the music playback
-func (s *Server) PlayMusic(filePath string) error {
-	if s.streaming {
-		return errors.New("music is already playing")
+	done := make(chan bool)
+
+	go func() {
+		s.goroutines.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// Clients didn't close their connections in time
+		s.mutex.RLock()
+
+		for endpoint := range s.connections {
+			endpoint.close()
+		}
+
+		s.mutex.RUnlock()
+
+		return ctx.Err()
 	}
+}
+
+// isShutDown checks if the server is shutting down
+func (s *Server) isShutDown() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
-	sampleRate, err := s.music.Load(filePath)
+	return s.shutDown
+}
+
+// startDiscovery answers discovery requests of clients
+func (s *Server) startDiscovery() {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: discoveryPort})
 
+	// Server is still reachable using its address
 	if err != nil {
-		return err
+		log.Error("Unable to answer discovery requests: ", err)
+
+		return
 	}
 
-	log.Debug("Preparing music playback")
+	s.discovery = conn
 
-	s.allEndpoints(func(endpoint *endpoint) error {
-		return endpoint.preparePlayback(sampleRate)
-	}, func(endpoint *endpoint, err error) {
-		log.Errorf("Unable to start playback for '%s': %s", endpoint.name, err)
+	go answerDiscovery(conn, &serverInfoPacket{
+		controlPort: s.controlListener.Addr().(*net.TCPAddr).Port,
+		streamPort:  s.streamListener.Addr().(*net.TCPAddr).Port,
+		name:        s.discoveryName,
 	})
+}
 
-	select {
-	case <-s.streamReady:
-	case <-time.After(streamReadyTimeout):
-		log.Info("Waiting for endpoints timed out")
+// EnableMulticast streams the music to a multicast group instead of
+// separate connections, needs to be called before starting the server
+func (s *Server) EnableMulticast(group *net.UDPAddr) {
+	s.multicastAddr = group
+}
+
+// EnableDiscovery lets clients find the server on the local network,
+// needs to be called before starting the server
+func (s *Server) EnableDiscovery(name string) error {
+	if name == "" || len(name) > maxServerNameLength {
+		return fmt.Errorf("server name must have 1 to %d characters", maxServerNameLength)
 	}
 
-	s.streaming = true
-	go s.streamMusic()
+	s.discoveryName = name
 
 	return nil
 }
 
-// StopMusic stops the music playback
-func (s *Server) StopMusic() error {
-	if !s.streaming {
-		return errors.New("music is currently not playing")
+// SetSlowClientPolicy specifies what happens when a client can't keep up
+func (s *Server) SetSlowClientPolicy(policy SlowClientPolicy) {
+	s.slowClientPolicy = policy
+}
+
+// SetLeadWindow specifies how far samples are streamed ahead of their playback
+// for clients that haven't reported their buffer targets
+func (s *Server) SetLeadWindow(lead time.Duration) error {
+	if lead < minLeadWindow || lead > maxLeadWindow {
+		return fmt.Errorf("lead window must be between %s and %s", minLeadWindow, maxLeadWindow)
 	}
 
-	err := s.music.Close()
+	s.leadWindow = lead
 
-	s.allEndpoints(func(endpoint *endpoint) error {
-		return endpoint.preparePlayback(0)
-	}, func(endpoint *endpoint, err error) {
-		log.Errorf("Unable to stop playback for '%s': %s", endpoint.name, err)
-	})
+	return nil
+}
 
-	s.allEndpoints(func(endpoint *endpoint) error {
-		return endpoint.disconnectStream()
-	}, func(endpoint *endpoint, err error) {
-		log.Errorf("Error disconnecting stream of '%s': %s", endpoint.name, err)
-	})
+// SetSampleRate resamples all tracks to the given rate (0 streams each track at its own rate),
+// clients don't need to recreate their players when the track changes
+func (s *Server) SetSampleRate(sampleRate int) error {
+	if err := checkSampleRate(sampleRate); err != nil {
+		return err
+	}
 
-	s.streaming = false
+	s.music.SetOutputRate(sampleRate)
 
-	return err
+	return nil
 }
 
-// SetVolume sets the volume of the specified user (or all users)
-func (s *Server) SetVolume(user string, volume int) error {
-	found := false
+// SetGainMode normalizes the loudness of the tracks using their ReplayGain tags,
+// the loudness of untagged tracks is measured in the background and cached
+func (s *Server) SetGainMode(mode audio.GainMode) error {
+	s.music.SetGainMode(mode)
 
-	s.allEndpoints(func(endpoint *endpoint) error {
-		if endpoint.name != user && user != "all" {
-			return nil
-		}
+	if mode == audio.GainOff || s.scanner != nil {
+		return nil
+	}
 
-		found = true
+	cacheDir, err := os.UserCacheDir()
 
-		return endpoint.changeVolume(volume)
-	}, func(endpoint *endpoint, err error) {
-		log.Debugf("Error changing volume of '%s'", endpoint.name)
-	})
+	if err != nil {
+		return err
+	}
 
-	if !found {
-		return fmt.Errorf("no user with name '%s' found", user)
+	scanner, err := audio.NewLoudnessScanner(filepath.Join(cacheDir, loudnessCacheFile), logScan)
+
+	if err != nil {
+		return err
 	}
 
+	s.scanner = scanner
+	s.music.SetLoudnessScanner(scanner)
+
 	return nil
 }
 
-func (s *Server) listenControl() {
-	for {
-		conn, err := s.controlListener.Accept()
+func logScan(path string, loudness float64, err error) {
+	if err != nil {
+		log.Errorf("Unable to measure the loudness of '%s': %s", path, err)
 
-		if err != nil {
-			log.Error("Unable to accept control client: ", err)
+		return
+	}
 
-			continue
-		}
+	log.Debugf("Measured the loudness of '%s' (%.1f LUFS)", path, loudness)
+}
+
+// SetHeartbeatTimeout specifies after which time silent clients are disconnected
+func (s *Server) SetHeartbeatTimeout(timeout time.Duration) error {
+	if err := checkHeartbeatTimeout(timeout); err != nil {
+		return err
+	}
 
-		ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+	s.heartbeatTimeout = timeout
 
-		s.mutex.Lock()
+	return nil
+}
 
-		// Check if client is already connected
-		if _, ok := s.endpoints[ip]; ok {
-			log.Debugf("Duplicate connection from client with IP '%s'", ip)
-			conn.Close()
-		} else {
-			// New endpoint connected
-			log.Debugf("New control connection from '%s'", ip)
-			s.endpoints[ip] = newEndpoint(conn, s.handleStatusChange)
-		}
+// SetCodec compresses the stream for clients supporting the codec,
+// needs to be called before starting the server
+func (s *Server) SetCodec(codec Codec) {
+	s.codec = codec
+}
 
-		s.mutex.Unlock()
+// EnableSecurity requires clients to connect using TLS,
+// needs to be called before starting the server
+func (s *Server) EnableSecurity(config *SecurityConfig) error {
+	var err error
+	s.security, err = newServerSecurity(config)
+
+	return err
+}
+
+// GetConnectedUsers returns a list of the currently connected users
+func (s *Server) GetConnectedUsers() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	users := make([]string, 0, len(s.endpoints))
+
+	for _, endpoint := range s.endpoints {
+		users = append(users, endpoint.name)
 	}
+
+	return users
 }
 
-func (s *Server) listenStream() {
-	for {
-		conn, err := s.streamListener.Accept()
+// PlayMusic replaces the queue with a file or directory and starts playing it
+func (s *Server) PlayMusic(path string) error {
+	if err := s.claimPlayback(); err != nil {
+		return err
+	}
 
-		if err != nil {
-			log.Error("Unable to accept stream client: ", err)
+	tracks, err := resolveTracks(path)
 
-			continue
-		}
+	if err != nil {
+		s.releasePlayback()
 
-		ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		return err
+	}
 
-		s.mutex.RLock()
+	previous, current := s.queue.replace(tracks, 0)
+	err = s.startPlayback()
 
-		// Check if there's a control connection available
-		if endpoint, ok := s.endpoints[ip]; ok {
-			if s.streaming {
-				log.Debugf("Client '%s' connected while streaming", ip)
-				conn.Close()
-			} else {
-				log.Debugf("New stream connection from '%s'", ip)
-				endpoint.connectStream(conn)
-				s.checkStreamReady()
-			}
-		} else {
-			// No control connection
-			conn.Close()
-		}
+	// Path only contains files that can't be played, keep the previous queue
+	if err != nil {
+		s.queue.replace(previous, current)
+		s.releasePlayback()
 
-		s.mutex.RUnlock()
+		return &PathError{path, err}
 	}
+
+	return nil
 }
 
-func (s *Server) checkStreamReady() {
-	streamReady := true
+// PlayQueue initiates the music playback at the current track of the queue
+func (s *Server) PlayQueue() error {
+	if err := s.claimPlayback(); err != nil {
+		return err
+	}
 
-	// Check if all endpoints are ready
-	for _, endpoint := range s.endpoints {
-		if endpoint.stream == nil {
-			streamReady = false
+	err := s.startPlayback()
 
-			break
-		}
+	if err != nil {
+		s.releasePlayback()
 	}
 
-	// Start music if all endpoints are ready
-	if streamReady {
-		s.streamReady <- true
+	return err
+}
+
+// claimPlayback keeps other playbacks from starting until it is started or released
+func (s *Server) claimPlayback() error {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	if s.streaming || s.starting {
+		return ErrAlreadyPlaying
 	}
+
+	s.starting = true
+
+	return nil
 }
 
-func (s *Server) streamMusic() {
-	for {
-		samples, err := s.music.Read()
+func (s *Server) releasePlayback() {
+	s.playbackMutex.Lock()
+	s.starting = false
+	s.playbackMutex.Unlock()
+}
 
-		// Music was closed
-		if err != nil {
-			return
-		}
+// startPlayback prepares the endpoints and streams the claimed playback,
+// the claim is kept if no track can be loaded
+func (s *Server) startPlayback() error {
+	s.playbackMutex.Lock()
+	format, err := s.loadTrack()
+	s.playbackMutex.Unlock()
 
-		// Music has ended
-		if len(samples) == 0 {
-			continue
-		}
+	if err != nil {
+		return err
+	}
 
-		s.allEndpoints(func(endpoint *endpoint) error {
-			return endpoint.streamSamples(samples)
-		}, func(endpoint *endpoint, err error) {
-			log.Debugf("Unable to stream samples to '%s'", endpoint.name)
-		})
+	log.Debug("Preparing music playback")
+
+	// Discard notification of a previous playback
+	select {
+	case <-s.streamReady:
+	default:
 	}
-}
 
-func (s *Server) allEndpoints(action func(*endpoint) error, fail func(*endpoint, error)) {
+	s.allEndpoints(func(endpoint *endpoint) error {
+		return endpoint.preparePlayback(format, s.streamCodec(endpoint))
+	}, func(endpoint *endpoint, err error) {
+		log.Errorf("Unable to start playback for '%s': %s", endpoint.name, err)
+	})
+
+	// Endpoints might have attached their streams already
 	s.mutex.RLock()
+	s.checkStreamReady()
+	s.mutex.RUnlock()
 
-	for _, endpoint := range s.endpoints {
-		if err := action(endpoint); err != nil {
-			fail(endpoint, err)
+	// Multicast doesn't need stream connections
+	if s.multicast == nil {
+		select {
+		case <-s.streamReady:
+		case <-time.After(streamReadyTimeout):
+			log.Info("Waiting for endpoints timed out")
 		}
 	}
 
-	s.mutex.RUnlock()
+	lead := s.streamLead()
+
+	s.playbackMutex.Lock()
+
+	// Give clients time to buffer the first samples
+	s.format = format
+	s.startTime = now() + int64(lead)
+	s.position = 0
+	s.sentChunks = nil
+	s.unplayed = nil
+	s.pendingTrack = nil
+	s.queueEnded = false
+
+	s.starting = false
+	s.streaming = true
+	s.paused = false
+	s.generation++
+	s.announceTrack(s.track, s.startTime)
+	generation := s.generation
+	s.playbackMutex.Unlock()
+
+	go s.streamMusic(generation)
+
+	return nil
 }
 
-func (s *Server) handleStatusChange(endpoint *endpoint, connected bool) {
-	if connected {
-		log.Infof("Endpoint '%s' has connected", endpoint.name)
-	} else {
-		log.Infof("Endpoint '%s' has disconnected", endpoint.name)
+// StopMusic stops the music playback
+func (s *Server) StopMusic() error {
+	s.playbackMutex.Lock()
 
-		s.mutex.Lock()
+	if !s.streaming {
+		s.playbackMutex.Unlock()
 
-		delete(s.endpoints, endpoint.ip.String())
+		return ErrNotPlaying
+	}
 
-		s.mutex.Unlock()
+	err := s.endPlayback()
+	s.playbackMutex.Unlock()
+
+	s.closePlayers()
+
+	return err
+}
+
+// endPlayback stops streaming, the playback mutex is held by the caller
+func (s *Server) endPlayback() error {
+	err := s.music.Close()
+	s.streaming = false
+
+	// Wake up paused stream
+	s.playbackCond.Broadcast()
+
+	return err
+}
+
+// closePlayers closes the players and streams of all endpoints
+func (s *Server) closePlayers() {
+	s.allEndpoints(func(endpoint *endpoint) error {
+		return endpoint.preparePlayback(audio.Format{}, CodecPCM)
+	}, func(endpoint *endpoint, err error) {
+		log.Errorf("Unable to stop playback for '%s': %s", endpoint.name, err)
+	})
+
+	s.allEndpoints(func(endpoint *endpoint) error {
+		return endpoint.disconnectStream()
+	}, func(endpoint *endpoint, err error) {
+		log.Errorf("Error disconnecting stream of '%s': %s", endpoint.name, err)
+	})
+}
+
+// Pause pauses the music playback at the current sample
+func (s *Server) Pause() error {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	if !s.streaming {
+		return ErrNotPlaying
+	}
+
+	if s.paused {
+		return errors.New("music is already paused")
+	}
+
+	pauseTime := now() + int64(pauseDelay)
+
+	s.paused = true
+	s.epoch++
+	s.keepUnplayed(pauseTime)
+	s.sendPause(pauseTime)
+
+	return nil
+}
+
+// Resume resumes the paused music playback
+func (s *Server) Resume() error {
+	lead := s.streamLead()
+
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	if !s.streaming {
+		return ErrNotPlaying
+	}
+
+	if !s.paused {
+		return errors.New("music is currently not paused")
+	}
+
+	s.paused = false
+	s.epoch++
+	s.startTime = now() + int64(lead)
+	s.position = 0
+	s.sendPause(s.startTime)
+
+	s.playbackCond.Broadcast()
+
+	return nil
+}
+
+// Seek moves the music playback to the given position
+func (s *Server) Seek(position time.Duration) error {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	if !s.streaming {
+		return ErrNotPlaying
+	}
+
+	if err := s.music.Seek(position); err != nil {
+		return err
+	}
+
+	// Clients discard the previous samples, the new position starts right away
+	s.epoch++
+	s.startTime = now() + int64(flushDelay)
+	s.position = 0
+	s.sentChunks = nil
+	s.unplayed = nil
+	s.queueEnded = false
+	s.playbackCond.Broadcast()
+
+	s.allEndpoints(func(endpoint *endpoint) error {
+		return endpoint.flushPlayback(s.epoch, s.startTime)
+	}, func(endpoint *endpoint, err error) {
+		log.Errorf("Unable to flush playback for '%s': %s", endpoint.name, err)
+	})
+
+	return nil
+}
+
+// Position returns the position of the currently played sample
+func (s *Server) Position() (time.Duration, error) {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	if !s.streaming {
+		return 0, ErrNotPlaying
+	}
+
+	return s.playbackPosition().offset, nil
+}
+
+// Status returns the current state of the music playback
+func (s *Server) Status() Status {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	status := Status{
+		Playing: s.streaming,
+		Repeat:  s.queue.repeatMode(),
+	}
+
+	if s.streaming {
+		position := s.playbackPosition()
+
+		status.Paused = s.paused
+		status.Track = position.track.path
+		status.Metadata = position.track.metadata
+		status.Position = position.offset
+		status.Length = position.track.length
+	}
+
+	return status
+}
+
+// NowPlaying returns the metadata of the currently played track
+func (s *Server) NowPlaying() (audio.Metadata, error) {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	if !s.streaming {
+		return audio.Metadata{}, ErrNotPlaying
+	}
+
+	return s.playbackPosition().track.metadata, nil
+}
+
+// playbackPosition returns the track and position of the currently played sample
+func (s *Server) playbackPosition() trackPosition {
+	var played, upcoming *trackPosition
+	currentTime := now()
+
+	for _, chunk := range s.sentChunks {
+		if chunk.timestamp > currentTime {
+			if upcoming == nil {
+				upcoming = &chunk.source
+			}
+
+			continue
+		}
+
+		end := s.chunkEnd(chunk)
+
+		if currentTime < end {
+			return s.clampPosition(chunk.source.advance(currentTime - chunk.timestamp))
+		}
+
+		// Chunk has already been played
+		position := chunk.source.advance(end - chunk.timestamp)
+		played = &position
+	}
+
+	if played != nil {
+		return s.clampPosition(*played)
+	}
+
+	// Playback hasn't started yet or is paused
+	if upcoming != nil {
+		return *upcoming
+	}
+
+	if len(s.unplayed) > 0 {
+		return s.unplayed[0].source
+	}
+
+	return trackPosition{
+		track:  s.track,
+		offset: s.music.Position(),
+	}
+}
+
+func (s *Server) clampPosition(position trackPosition) trackPosition {
+	if length := position.track.length; length > 0 && position.offset > length {
+		position.offset = length
+	}
+
+	return position
+}
+
+// Length returns the length of the currently played music
+func (s *Server) Length() (time.Duration, error) {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	if !s.streaming {
+		return 0, ErrNotPlaying
+	}
+
+	return s.playbackPosition().track.length, nil
+}
+
+// Next skips to the next track of the queue
+func (s *Server) Next() error {
+	return s.skipTrack(func() bool {
+		return s.queue.advance(true)
+	})
+}
+
+// Previous goes back to the previous track of the queue
+func (s *Server) Previous() error {
+	return s.skipTrack(s.queue.back)
+}
+
+// Queue returns the tracks of the queue and the index of the current one
+func (s *Server) Queue() ([]string, int) {
+	return s.queue.list()
+}
+
+// Enqueue appends a file or all audio files of a directory to the queue
+func (s *Server) Enqueue(path string) (int, error) {
+	count, err := s.queue.add(path)
+
+	if err == nil {
+		s.scanQueue()
+	}
+
+	return count, err
+}
+
+// Dequeue removes the track with the given index from the queue
+func (s *Server) Dequeue(index int) error {
+	return s.queue.remove(index)
+}
+
+// MoveTrack changes the position of a track in the queue
+func (s *Server) MoveTrack(from int, to int) error {
+	return s.queue.move(from, to)
+}
+
+// ClearQueue removes all tracks from the queue except for the playing one
+func (s *Server) ClearQueue() {
+	s.playbackMutex.Lock()
+	playing := s.streaming || s.starting
+	s.playbackMutex.Unlock()
+
+	s.queue.clear(playing)
+}
+
+// Shuffle randomizes the order of the upcoming tracks
+func (s *Server) Shuffle() {
+	s.queue.shuffle()
+}
+
+// SetRepeat sets what happens at the end of a track
+func (s *Server) SetRepeat(mode RepeatMode) {
+	s.queue.setRepeat(mode)
+}
+
+// Repeat returns what happens at the end of a track
+func (s *Server) Repeat() RepeatMode {
+	return s.queue.repeatMode()
+}
+
+// SetVolume sets the volume of the specified user (or all users),
+// the volume is kept when the user reconnects
+func (s *Server) SetVolume(user string, volume int) error {
+	found := false
+	var volumeErr error
+	var changed []string
+
+	s.allEndpoints(func(endpoint *endpoint) error {
+		if endpoint.name != user && user != "all" {
+			return nil
+		}
+
+		found = true
+
+		// Users without volume control are skipped when changing all volumes
+		if user == "all" && !endpoint.capabilities.volumeControl {
+			return nil
+		}
+
+		if err := endpoint.changeVolume(volume); err != nil {
+			return err
+		}
+
+		changed = append(changed, endpoint.id)
+
+		// System volume is unmuted when changing it
+		if s.mutes[endpoint.id] {
+			return endpoint.mute(true)
+		}
+
+		return nil
+	}, func(endpoint *endpoint, err error) {
+		log.Debugf("Error changing volume of '%s'", endpoint.name)
+
+		if err == errNoVolumeControl {
+			volumeErr = fmt.Errorf("user '%s' is unable to change the volume", user)
+		}
+	})
+
+	if !found {
+		return fmt.Errorf("no user with name '%s' found", user)
+	}
+
+	s.mutex.Lock()
+
+	for _, id := range changed {
+		s.volumes[id] = volume
+	}
+
+	s.mutex.Unlock()
+
+	return volumeErr
+}
+
+// SetMuted mutes or unmutes the specified user (or all users) without changing the volume,
+// the user stays muted when reconnecting
+func (s *Server) SetMuted(user string, muted bool) error {
+	found := false
+	var muteErr error
+	var changed []string
+
+	s.allEndpoints(func(endpoint *endpoint) error {
+		if endpoint.name != user && user != "all" {
+			return nil
+		}
+
+		found = true
+
+		// Users without mute are skipped when changing all of them
+		if user == "all" && !endpoint.capabilities.volumeControl {
+			return nil
+		}
+
+		if err := endpoint.mute(muted); err != nil {
+			return err
+		}
+
+		changed = append(changed, endpoint.id)
+
+		return nil
+	}, func(endpoint *endpoint, err error) {
+		log.Debugf("Error muting '%s'", endpoint.name)
+
+		if err == errNoMute {
+			muteErr = fmt.Errorf("user '%s' is unable to mute", user)
+		}
+	})
+
+	if !found {
+		return fmt.Errorf("no user with name '%s' found", user)
+	}
+
+	s.mutex.Lock()
+
+	for _, id := range changed {
+		s.mutes[id] = muted
+	}
+
+	s.mutex.Unlock()
+
+	return muteErr
+}
+
+// SetChannelMap specifies which channels are played on a user's speakers,
+// the channel map is kept when the user reconnects
+func (s *Server) SetChannelMap(user string, mapping audio.ChannelMap) error {
+	found := false
+	var mapped []string
+
+	s.allEndpoints(func(endpoint *endpoint) error {
+		if endpoint.name != user && user != "all" {
+			return nil
+		}
+
+		found = true
+
+		if err := endpoint.mapChannels(mapping); err != nil {
+			return err
+		}
+
+		mapped = append(mapped, endpoint.id)
+
+		return nil
+	}, func(endpoint *endpoint, err error) {
+		log.Debugf("Error changing channel map of '%s'", endpoint.name)
+	})
+
+	if !found {
+		return fmt.Errorf("no user with name '%s' found", user)
+	}
+
+	s.mutex.Lock()
+
+	for _, id := range mapped {
+		s.channelMaps[id] = mapping
+	}
+
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func (s *Server) listenControl() {
+	defer s.goroutines.Done()
+
+	for {
+		conn, err := s.controlListener.Accept()
+
+		if err != nil {
+			if s.isShutDown() {
+				return
+			}
+
+			log.Error("Unable to accept control client: ", err)
+
+			continue
+		}
+
+		s.goroutines.Add(1)
+
+		go func() {
+			defer s.goroutines.Done()
+
+			s.acceptControl(conn)
+		}()
+	}
+}
+
+// acceptControl creates the endpoint for a new control connection
+func (s *Server) acceptControl(conn net.Conn) {
+	log.Debugf("New control connection from '%s'", conn.RemoteAddr())
+
+	conn, err := s.secure(conn)
+
+	if err != nil {
+		log.Infof("Rejected control connection from '%s': %s", conn.RemoteAddr(), err)
+
+		return
+	}
+
+	// Endpoint is added after announcing itself
+	endpoint := newEndpoint(conn, s.multicastGroup(), s.heartbeatTimeout, s.handleStatusChange, s.handleBufferReport)
+
+	s.mutex.Lock()
+
+	// Connection was accepted while shutting down
+	if s.shutDown {
+		s.mutex.Unlock()
+		endpoint.close()
+
+		return
+	}
+
+	s.connections[endpoint] = true
+	s.mutex.Unlock()
+
+	endpoint.listen()
+
+	s.mutex.Lock()
+	delete(s.connections, endpoint)
+	s.mutex.Unlock()
+}
+
+// secure performs the TLS handshake if enabled
+func (s *Server) secure(conn net.Conn) (net.Conn, error) {
+	if s.security == nil {
+		return conn, nil
+	}
+
+	secureConn, err := s.security.server(conn)
+
+	if err != nil {
+		conn.Close()
+
+		return conn, err
+	}
+
+	return secureConn, nil
+}
+
+func (s *Server) multicastGroup() string {
+	if s.multicastAddr == nil {
+		return ""
+	}
+
+	return s.multicastAddr.String()
+}
+
+func (s *Server) listenStream() {
+	defer s.goroutines.Done()
+
+	for {
+		conn, err := s.streamListener.Accept()
+
+		if err != nil {
+			if s.isShutDown() {
+				return
+			}
+
+			log.Error("Unable to accept stream client: ", err)
+
+			continue
+		}
+
+		s.goroutines.Add(1)
+
+		go func() {
+			defer s.goroutines.Done()
+
+			s.attachStream(conn)
+		}()
+	}
+}
+
+// attachStream assigns a stream connection to the endpoint with the sent token
+func (s *Server) attachStream(conn net.Conn) {
+	conn, err := s.secure(conn)
+
+	if err != nil {
+		log.Infof("Rejected stream connection from '%s': %s", conn.RemoteAddr(), err)
+
+		return
+	}
+
+	stream := newProtocol(conn)
+
+	conn.SetReadDeadline(time.Now().Add(streamAttachTimeout))
+	packet, err := stream.receive()
+	conn.SetReadDeadline(time.Time{})
+
+	attach, ok := packet.(*attachPacket)
+
+	if err != nil || !ok {
+		log.Debugf("Invalid stream connection from '%s'", conn.RemoteAddr())
+		conn.Close()
+
+		return
+	}
+
+	s.playbackMutex.Lock()
+	s.mutex.Lock()
+
+	var endpoint *endpoint
+
+	for _, e := range s.endpoints {
+		if bytes.Equal(e.token, attach.token) {
+			endpoint = e
+
+			break
+		}
+	}
+
+	streaming := s.streaming
+
+	if endpoint != nil {
+		endpoint.connectStream(conn, s.slowClientPolicy)
+		endpoint.joining = streaming
+
+		if streaming {
+			log.Debugf("Client '%s' joined while streaming", endpoint.name)
+		} else {
+			log.Debugf("New stream connection from '%s'", endpoint.name)
+			s.checkStreamReady()
+		}
+	}
+
+	s.mutex.Unlock()
+	s.playbackMutex.Unlock()
+
+	if endpoint == nil {
+		// No matching control connection
+		log.Debugf("Unknown stream token from '%s'", conn.RemoteAddr())
+		conn.Close()
+
+		return
+	}
+
+	if streaming {
+		s.catchUp(endpoint)
+	}
+}
+
+// catchUp sends the unplayed chunks to a joining endpoint
+// until it receives the live stream
+func (s *Server) catchUp(endpoint *endpoint) {
+	for {
+		chunks := s.unsentChunks(endpoint)
+
+		if len(chunks) == 0 {
+			return
+		}
+
+		for _, chunk := range chunks {
+			if err := endpoint.sendStream(chunk, true); err != nil {
+				log.Debugf("Unable to stream samples to '%s'", endpoint.name)
+
+				return
+			}
+		}
+	}
+}
+
+// unsentChunks returns the unplayed chunks the endpoint didn't receive yet,
+// the endpoint has joined once there are none left
+func (s *Server) unsentChunks(endpoint *endpoint) []*chunkPacket {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	// Prevents streaming while checking the chunks
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Stream was closed in the meantime
+	if !endpoint.hasStream() {
+		endpoint.joining = false
+
+		return nil
+	}
+
+	chunks := make([]*chunkPacket, 0)
+	currentTime := now()
+
+	for _, chunk := range s.sentChunks {
+		if s.chunkEnd(chunk) <= currentTime {
+			continue
+		}
+
+		if endpoint.hasSent(chunk) || !s.isCurrentFormat(chunk) {
+			continue
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	if len(chunks) == 0 {
+		endpoint.joining = false
+	}
+
+	return chunks
+}
+
+// joinPlayback prepares the player of an endpoint that connected while streaming
+func (s *Server) joinPlayback(endpoint *endpoint) {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	if !s.streaming {
+		return
+	}
+
+	if err := endpoint.preparePlayback(s.format, s.streamCodec(endpoint)); err != nil {
+		log.Errorf("Unable to start playback for '%s': %s", endpoint.name, err)
+	}
+
+	// Endpoint has missed the announcement of the current track
+	if err := endpoint.announceTrack(s.playbackPosition().track.metadata); err != nil {
+		log.Errorf("Unable to announce track to '%s': %s", endpoint.name, err)
+	}
+}
+
+// streamCodec chooses the codec of the stream to an endpoint
+func (s *Server) streamCodec(endpoint *endpoint) Codec {
+	if endpoint.supportsCodec(s.codec) {
+		return s.codec
+	}
+
+	// Multicast stream is shared by all endpoints, the endpoint is refused
+	if s.multicast != nil {
+		return s.codec
+	}
+
+	log.Infof("Endpoint '%s' doesn't support %s, streaming uncompressed", endpoint.name, s.codec)
+
+	return CodecPCM
+}
+
+func (s *Server) checkStreamReady() {
+	streamReady := true
+
+	// Check if all endpoints are ready
+	for _, endpoint := range s.endpoints {
+		if !endpoint.hasStream() {
+			streamReady = false
+
+			break
+		}
+	}
+
+	// Start music if all endpoints are ready
+	if streamReady {
+		select {
+		case s.streamReady <- true:
+		default:
+		}
+	}
+}
+
+// streamMusic streams the packets of a playback until it is stopped
+func (s *Server) streamMusic(generation int) {
+	for {
+		packet, err := s.nextPacket(generation)
+
+		// Music was stopped
+		if err != nil {
+			return
+		}
+
+		// Track has changed
+		if packet == nil {
+			continue
+		}
+
+		// Samples are streamed at the pace they are played
+		if chunk, ok := packet.(*chunkPacket); ok {
+			time.Sleep(time.Duration(chunk.timestamp - int64(s.streamLead()) - now()))
+
+			// Music was stopped while waiting
+			if !s.isPlayback(generation) {
+				return
+			}
+		}
+
+		if s.multicast != nil {
+			switch p := packet.(type) {
+			case *chunkPacket:
+				packet = p.withCodec(s.codec)
+			case *trackPacket:
+				// Clients keep the right format if the datagram is lost
+				s.repeatTrack(s.multicast.nextSequence(), p)
+			}
+
+			if err := s.multicast.send(packet); err != nil {
+				log.Debug("Unable to send multicast datagram: ", err)
+			}
+
+			continue
+		}
+
+		s.allEndpoints(func(endpoint *endpoint) error {
+			return endpoint.streamPacket(packet)
+		}, func(endpoint *endpoint, err error) {
+			if err != errClientTooSlow {
+				log.Debugf("Unable to stream samples to '%s'", endpoint.name)
+
+				return
+			}
+
+			// Client joins again after reconnecting
+			log.Infof("Disconnecting '%s', client is too slow", endpoint.name)
+			endpoint.disconnectStream()
+			endpoint.close()
+		})
+	}
+}
+
+func (s *Server) repeatTrack(sequence uint32, track *trackPacket) {
+	s.allEndpoints(func(endpoint *endpoint) error {
+		return endpoint.repeatTrack(sequence, track)
+	}, func(endpoint *endpoint, err error) {
+		log.Debugf("Unable to repeat track to '%s': %s", endpoint.name, err)
+	})
+}
+
+// streamLead returns how far samples are streamed ahead, covering the buffer targets
+// of all endpoints, the lead window is used for endpoints without a reported target
+func (s *Server) streamLead() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	lead := time.Duration(0)
+
+	for _, endpoint := range s.endpoints {
+		target := endpoint.bufferTarget
+
+		if target == 0 {
+			target = s.leadWindow
+		}
+
+		if target > lead {
+			lead = target
+		}
+	}
+
+	switch {
+	case lead == 0:
+		lead = s.leadWindow
+	case lead < minLeadWindow:
+		lead = minLeadWindow
+	case lead > maxLeadWindow:
+		lead = maxLeadWindow
+	}
+
+	return lead
+}
+
+// isPlayback checks if the playback is still streamed
+func (s *Server) isPlayback(generation int) bool {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	return s.isCurrentPlayback(generation)
+}
+
+// isCurrentPlayback checks if the playback is still streamed,
+// the playback mutex is held by the caller
+func (s *Server) isCurrentPlayback(generation int) bool {
+	return s.streaming && s.generation == generation
+}
+
+func (s *Server) nextPacket(generation int) (packet, error) {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	for s.isCurrentPlayback(generation) && (s.paused || s.queueEnded && len(s.unplayed) == 0) {
+		s.playbackCond.Wait()
+	}
+
+	if !s.isCurrentPlayback(generation) {
+		return nil, errMusicStopped
+	}
+
+	// New track is announced before its samples
+	if s.pendingTrack != nil {
+		track := s.pendingTrack
+		s.pendingTrack = nil
+
+		return track, nil
+	}
+
+	var samples []byte
+	var source trackPosition
+
+	// Samples that weren't played before pausing come first
+	if len(s.unplayed) > 0 {
+		samples = s.unplayed[0].samples
+		source = s.unplayed[0].source
+		s.unplayed = s.unplayed[1:]
+	} else {
+		var err error
+		source = trackPosition{
+			track:  s.track,
+			offset: s.music.Position(),
+		}
+		samples, err = s.music.Read()
+
+		if err != nil {
+			log.Error("Error reading music: ", err)
+		}
+	}
+
+	// Music has ended
+	if len(samples) == 0 {
+		if !s.queueEnded && s.queue.advance(false) {
+			// Next track follows without a gap
+			switchTime := s.startTime + s.framesDuration(s.position)
+
+			if switchTime < now() {
+				switchTime = now()
+			}
+
+			err := s.changeTrack(switchTime)
+
+			if err == nil {
+				return nil, nil
+			}
+
+			log.Error("Error changing track: ", err)
+		}
+
+		s.endQueue()
+
+		return nil, nil
+	}
+
+	frameSize := s.format.FrameSize()
+
+	// Long reads are streamed in several chunks of whole frames
+	if chunkSize := maxChunkSize - maxChunkSize%frameSize; len(samples) > chunkSize {
+		remaining := &unplayedSamples{
+			samples: samples[chunkSize:],
+			source:  source.advance(s.framesDuration(int64(chunkSize / frameSize))),
+		}
+		s.unplayed = append([]*unplayedSamples{remaining}, s.unplayed...)
+		samples = samples[:chunkSize]
+	}
+
+	chunk := &chunkPacket{
+		epoch:     s.epoch,
+		timestamp: s.startTime + s.framesDuration(s.position),
+		samples:   samples,
+		source:    source,
+	}
+
+	// Encode once for all endpoints
+	if s.codec != CodecPCM {
+		chunk.encoded = encodeSamples(s.codec, samples, s.format.Channels)
+	}
+
+	s.position += int64(len(samples) / frameSize)
+
+	// Remember chunks until they have been played
+	for len(s.sentChunks) > 0 && s.chunkEnd(s.sentChunks[0]) <= now() {
+		s.sentChunks = s.sentChunks[1:]
+	}
+
+	s.sentChunks = append(s.sentChunks, chunk)
+
+	return chunk, nil
+}
+
+// endQueue stops the playback once the last samples have been played
+func (s *Server) endQueue() {
+	generation := s.generation
+	epoch := s.epoch
+	endTime := s.startTime + s.framesDuration(s.position)
+
+	s.queueEnded = true
+
+	time.AfterFunc(time.Duration(endTime-now()), func() {
+		s.playbackMutex.Lock()
+
+		// Playback was changed in the meantime
+		if !s.isCurrentPlayback(generation) || !s.queueEnded || s.epoch != epoch {
+			s.playbackMutex.Unlock()
+
+			return
+		}
+
+		log.Info("Reached the end of the queue")
+		s.queue.rewind()
+		err := s.endPlayback()
+		s.playbackMutex.Unlock()
+
+		s.closePlayers()
+
+		if err != nil {
+			log.Error("Error stopping music playback: ", err)
+		}
+	})
+}
+
+// skipTrack moves through the queue and immediately plays the new track
+func (s *Server) skipTrack(move func() bool) error {
+	s.playbackMutex.Lock()
+	defer s.playbackMutex.Unlock()
+
+	if !s.streaming {
+		return ErrNotPlaying
+	}
+
+	if !move() {
+		return errors.New("no more tracks in queue")
+	}
+
+	s.epoch++
+	s.sentChunks = nil
+	s.unplayed = nil
+	s.queueEnded = false
+	s.playbackCond.Broadcast()
+
+	// Previous samples are played while the new track is loaded
+	format, err := s.loadTrack()
+
+	if err != nil {
+		return err
+	}
+
+	// Clients discard the previous samples, the new track starts right away
+	switchTime := now() + int64(flushDelay)
+
+	s.allEndpoints(func(endpoint *endpoint) error {
+		return endpoint.flushPlayback(s.epoch, switchTime)
+	}, func(endpoint *endpoint, err error) {
+		log.Errorf("Unable to flush playback for '%s': %s", endpoint.name, err)
+	})
+
+	s.startTrack(format, switchTime)
+
+	return nil
+}
+
+// changeTrack loads the current track of the queue, starting at the given time
+func (s *Server) changeTrack(switchTime int64) error {
+	format, err := s.loadTrack()
+
+	if err != nil {
+		return err
+	}
+
+	s.startTrack(format, switchTime)
+
+	return nil
+}
+
+// startTrack plays the loaded track of the given format, starting at the given time
+func (s *Server) startTrack(format audio.Format, switchTime int64) {
+	s.startTime = switchTime
+	s.position = 0
+
+	if format != s.format {
+		s.pendingTrack = &trackPacket{
+			format:    format,
+			timestamp: switchTime,
+		}
+
+		// Clients need time to recreate their player
+		if format.SampleRate != s.format.SampleRate {
+			s.startTime += int64(trackChangeDelay)
+		}
+
+		s.format = format
+	}
+
+	s.announceTrack(s.track, s.startTime)
+}
+
+// announceTrack tells the endpoints about the track once it starts playing
+func (s *Server) announceTrack(track *streamedTrack, startTime int64) {
+	time.AfterFunc(time.Duration(startTime-now()), func() {
+		s.playbackMutex.Lock()
+		current := s.streaming && s.track == track
+		s.playbackMutex.Unlock()
+
+		// Track was stopped or skipped in the meantime
+		if !current {
+			return
+		}
+
+		log.Infof("Now playing '%s'", track.metadata)
+
+		s.allEndpoints(func(endpoint *endpoint) error {
+			return endpoint.announceTrack(track.metadata)
+		}, func(endpoint *endpoint, err error) {
+			log.Errorf("Unable to announce track to '%s': %s", endpoint.name, err)
+		})
+	})
+}
+
+// loadTrack loads the current track of the queue, skipping unreadable files
+func (s *Server) loadTrack() (audio.Format, error) {
+	tracks, _ := s.queue.list()
+
+	for range tracks {
+		track, ok := s.queue.track()
+
+		if !ok {
+			break
+		}
+
+		format, err := s.music.Load(track)
+
+		if err == nil {
+			format = s.music.SetChannels(s.streamChannels(format.Channels))
+
+			log.Debugf("Loaded track '%s' (%d Hz, %d channels)", track, format.SampleRate, format.Channels)
+
+			if gain, ok := s.music.Gain(); ok {
+				log.Debugf("Normalizing '%s' by %+.1f dB", track, gain)
+			} else if s.scanner != nil {
+				log.Infof("Playing '%s' unnormalized, its loudness is still being measured", track)
+			}
+
+			s.scanQueue()
+
+			s.track = &streamedTrack{
+				path:     track,
+				format:   format,
+				length:   s.music.Length(),
+				metadata: s.music.Metadata(),
+			}
+
+			return format, nil
+		}
+
+		log.Errorf("Unable to load '%s': %s", track, err)
+
+		if !s.queue.advance(true) {
+			break
+		}
+	}
+
+	return audio.Format{}, ErrNoPlayableTrack
+}
+
+// scanQueue measures the loudness of the tracks before they are played,
+// starting at the current track
+func (s *Server) scanQueue() {
+	if s.scanner == nil {
+		return
+	}
+
+	tracks, current := s.queue.list()
+
+	for i := range tracks {
+		s.scanner.Queue(tracks[(current+i)%len(tracks)])
+	}
+}
+
+// keepUnplayed keeps the samples that were sent but not played yet
+func (s *Server) keepUnplayed(pauseTime int64) {
+	unplayed := make([]*unplayedSamples, 0, len(s.sentChunks)+len(s.unplayed))
+
+	for _, chunk := range s.sentChunks {
+		// Samples can't be resent with a different format
+		if s.chunkEnd(chunk) <= pauseTime || !s.isCurrentFormat(chunk) {
+			continue
+		}
+
+		samples := &unplayedSamples{
+			samples: chunk.samples,
+			source:  chunk.source,
+		}
+
+		// Chunk is currently being played
+		if chunk.timestamp < pauseTime {
+			frames := s.format.Frames(time.Duration(pauseTime - chunk.timestamp))
+			samples.samples = samples.samples[frames*int64(s.format.FrameSize()):]
+			samples.source = samples.source.advance(s.framesDuration(frames))
+		}
+
+		unplayed = append(unplayed, samples)
+	}
+
+	s.unplayed = append(unplayed, s.unplayed...)
+	s.sentChunks = nil
+}
+
+func (s *Server) sendPause(timestamp int64) {
+	s.allEndpoints(func(endpoint *endpoint) error {
+		return endpoint.pausePlayback(s.paused, s.epoch, timestamp)
+	}, func(endpoint *endpoint, err error) {
+		log.Errorf("Unable to pause playback for '%s': %s", endpoint.name, err)
+	})
+}
+
+func (s *Server) chunkEnd(chunk *chunkPacket) int64 {
+	// Previous track might have had another format
+	format := chunk.source.track.format
+	frames := int64(len(chunk.samples) / format.FrameSize())
+
+	return chunk.timestamp + int64(format.Duration(frames))
+}
+
+func (s *Server) isCurrentFormat(chunk *chunkPacket) bool {
+	return chunk.source.track.format == s.format
+}
+
+func (s *Server) framesDuration(frames int64) int64 {
+	return int64(s.format.Duration(frames))
+}
+
+// streamChannels returns the channel count a track is streamed with,
+// it is mixed to stereo if a client can't play its channels
+func (s *Server) streamChannels(channels int) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, endpoint := range s.endpoints {
+		if !endpoint.capabilities.supportsChannels(channels) {
+			log.Debugf("Endpoint '%s' is unable to play %d channels, mixing to stereo", endpoint.name, channels)
+
+			return defaultChannels
+		}
+	}
+
+	return channels
+}
+
+func (s *Server) allEndpoints(action func(*endpoint) error, fail func(*endpoint, error)) {
+	s.mutex.RLock()
+
+	for _, endpoint := range s.endpoints {
+		if err := action(endpoint); err != nil {
+			fail(endpoint, err)
+		}
+	}
+
+	s.mutex.RUnlock()
+}
+
+func (s *Server) handleStatusChange(endpoint *endpoint, connected bool) {
+	if connected {
+		log.Infof("Endpoint '%s' has connected", endpoint.name)
+
+		s.mutex.Lock()
+
+		// Client has reconnected before the old connection timed out
+		if oldEndpoint, ok := s.endpoints[endpoint.id]; ok {
+			log.Debugf("Replacing previous connection of '%s'", endpoint.name)
+			oldEndpoint.close()
+		}
+
+		s.endpoints[endpoint.id] = endpoint
+		mapping, mapped := s.channelMaps[endpoint.id]
+		volume, changedVolume := s.volumes[endpoint.id]
+		muted := s.mutes[endpoint.id]
+
+		s.mutex.Unlock()
+
+		// Clients start with the stereo channel map after connecting
+		if mapped {
+			if err := endpoint.mapChannels(mapping); err != nil {
+				log.Errorf("Unable to restore channel map of '%s': %s", endpoint.name, err)
+			}
+		}
+
+		if changedVolume {
+			if err := endpoint.changeVolume(volume); err != nil {
+				log.Errorf("Unable to restore volume of '%s': %s", endpoint.name, err)
+			}
+		}
+
+		if muted {
+			if err := endpoint.mute(true); err != nil {
+				log.Errorf("Unable to mute '%s': %s", endpoint.name, err)
+			}
+		}
+
+		s.joinPlayback(endpoint)
+	} else {
+		log.Infof("Endpoint '%s' has disconnected", endpoint.name)
+
+		s.mutex.Lock()
+
+		// Endpoint might have been replaced already
+		if s.endpoints[endpoint.id] == endpoint {
+			delete(s.endpoints, endpoint.id)
+		}
+
+		s.mutex.Unlock()
+	}
+}
+
+func (s *Server) handleBufferReport(endpoint *endpoint, report *bufferPacket) {
+	target := time.Duration(report.target)
+	fill := time.Duration(report.fill).Round(time.Millisecond)
+
+	s.mutex.Lock()
+
+	if endpoint.bufferTarget != target {
+		log.Debugf("Buffer target of '%s' is %s", endpoint.name, target)
+		endpoint.bufferTarget = target
+	}
+
+	s.mutex.Unlock()
+
+	if report.underruns > 0 {
+		log.Infof("Buffer of '%s' ran empty (%d underruns), holds %s of %s",
+			endpoint.name, report.underruns, fill, target)
+	} else {
+		log.Debugf("Buffer of '%s' holds %s of %s (round trip %s)", endpoint.name, fill, target, endpoint.roundTrip)
 	}
 }
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/medusalix/multispeaker/log"
+)
+
+func TestMain(m *testing.M) {
+	// Logs of the tested code are discarded
+	log.Init(func(format string, params ...interface{}) {}, "error")
+
+	os.Exit(m.Run())
+}
+
+// writeTestTrack writes a silent WAV file (16 bit, stereo)
+func writeTestTrack(t *testing.T, path string, sampleRate int, duration time.Duration) {
+	dataSize := int(int64(sampleRate)*int64(duration)/int64(time.Second)) * 4
+	header := make([]byte, 44)
+
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+dataSize))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], 1)
+	binary.LittleEndian.PutUint16(header[22:], 2)
+	binary.LittleEndian.PutUint32(header[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(sampleRate*4))
+	binary.LittleEndian.PutUint16(header[32:], 4)
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(dataSize))
+
+	if err := os.WriteFile(path, append(header, make([]byte, dataSize)...), 0644); err != nil {
+		t.Fatal("Unable to write track: ", err)
+	}
+}
+
+// Playbacks are started and stopped from several goroutines,
+// the queue also ends while doing so (run with -race)
+func TestConcurrentPlayback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "track.wav")
+	writeTestTrack(t, path, 8000, time.Millisecond*50)
+
+	server := NewServer(nil, nil)
+	deadline := time.Now().Add(time.Second * 3)
+	var wait sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+
+		go func(seed int64) {
+			defer wait.Done()
+
+			random := rand.New(rand.NewSource(seed))
+
+			for time.Now().Before(deadline) {
+				var err error
+
+				// Stopping is rare, so the queue also ends by itself
+				switch n := random.Intn(1000); {
+				case n < 400:
+					err = server.PlayMusic(path)
+				case n < 800:
+					err = server.PlayQueue()
+				case n < 999:
+					server.Status()
+				default:
+					err = server.StopMusic()
+				}
+
+				// Queue is empty until the music is played the first time
+				if err != nil && err != ErrAlreadyPlaying && err != ErrNotPlaying && err != ErrNoPlayableTrack {
+					t.Error("Unexpected error: ", err)
+				}
+
+				time.Sleep(time.Duration(random.Intn(int(time.Millisecond * 20))))
+			}
+		}(int64(i))
+	}
+
+	wait.Wait()
+	server.StopMusic()
+
+	if server.Status().Playing {
+		t.Error("Music is still playing after stopping it")
+	}
+}
+
+// Paths that can't be played leave the queue untouched
+func TestPlayMusicInvalidPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "track.wav")
+	writeTestTrack(t, path, 8000, time.Millisecond*50)
+
+	invalid := filepath.Join(dir, "invalid.mp3")
+
+	if err := os.WriteFile(invalid, []byte("invalid"), 0644); err != nil {
+		t.Fatal("Unable to write track: ", err)
+	}
+
+	server := NewServer(nil, nil)
+
+	if _, err := server.Enqueue(path); err != nil {
+		t.Fatal("Unable to enqueue track: ", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		err  error
+	}{
+		{"missing", filepath.Join(dir, "missing.wav"), os.ErrNotExist},
+		{"empty directory", t.TempDir(), nil},
+		{"unplayable", invalid, ErrNoPlayableTrack},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := server.PlayMusic(test.path)
+			var pathErr *PathError
+
+			if !errors.As(err, &pathErr) || pathErr.Path != test.path {
+				t.Fatal("Expected path error, got: ", err)
+			}
+
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("Expected '%s', got '%s'", test.err, err)
+			}
+
+			if tracks, _ := server.Queue(); len(tracks) != 1 || tracks[0] != path {
+				t.Error("Queue was changed: ", tracks)
+			}
+		})
+	}
+
+	// Claim of the failed playbacks was released
+	if err := server.PlayQueue(); err != nil {
+		t.Fatal("Unable to play queue: ", err)
+	}
+
+	server.StopMusic()
+}
+
+// Buffer targets of the clients drive the lead, the lead window is used until they report
+func TestStreamLead(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []time.Duration
+		lead    time.Duration
+	}{
+		{"no endpoints", nil, DefaultLeadWindow},
+		{"unreported target", []time.Duration{0}, DefaultLeadWindow},
+		{"shorter target", []time.Duration{time.Millisecond * 200}, time.Millisecond * 200},
+		{"largest target", []time.Duration{time.Millisecond * 200, time.Second}, time.Second},
+		{"partly unreported", []time.Duration{time.Millisecond * 200, 0}, DefaultLeadWindow},
+		{"below minimum", []time.Duration{time.Millisecond * 50}, minLeadWindow},
+		{"above maximum", []time.Duration{time.Second * 5}, maxLeadWindow},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := NewServer(nil, nil)
+
+			for i, target := range test.targets {
+				id := string(rune('a' + i))
+				server.endpoints[id] = &endpoint{id: id, bufferTarget: target}
+			}
+
+			if lead := server.streamLead(); lead != test.lead {
+				t.Errorf("Expected lead of %s, got %s", test.lead, lead)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2018 Medusalix
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	volume "github.com/itchyny/volume-go"
+)
+
+// VolumeMode specifies how the client changes its volume
+type VolumeMode int
+
+const (
+	// VolumeSoftware attenuates the samples in the player, other applications aren't affected
+	VolumeSoftware VolumeMode = iota
+	// VolumeSystem changes the volume of the operating system
+	VolumeSystem
+)
+
+var volumeModeNames = []string{"software", "system"}
+
+// ParseVolumeMode returns the volume mode with the given name
+func ParseVolumeMode(name string) (VolumeMode, error) {
+	for i, modeName := range volumeModeNames {
+		if strings.EqualFold(name, modeName) {
+			return VolumeMode(i), nil
+		}
+	}
+
+	return VolumeSoftware, fmt.Errorf("unknown volume mode '%s'", name)
+}
+
+func (m VolumeMode) String() string {
+	return volumeModeNames[m]
+}
+
+// canChangeSystemVolume checks if the system's volume can be controlled
+func canChangeSystemVolume() bool {
+	_, err := volume.GetVolume()
+
+	return err == nil
+}
+
+// setSystemVolume changes the volume of the operating system
+func setSystemVolume(vol int) error {
+	// Throws error when already unmuted
+	volume.Unmute()
+
+	return volume.SetVolume(vol)
+}
+
+// muteSystemVolume mutes or unmutes the operating system
+func muteSystemVolume(muted bool) error {
+	if muted {
+		return volume.Mute()
+	}
+
+	// Throws error when already unmuted
+	volume.Unmute()
+
+	return nil
+}